@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	agentRunningBuildElapsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "running_build_elapsed_seconds"),
+		"How long the build running on the agent has been running",
+		[]string{"name", "pool", "build_type", "project", "branch"}, nil,
+	)
+
+	agentPoolBusySeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent_pool", "busy_seconds_total"),
+		"How long agents of the pool were seen running builds",
+		[]string{"pool"}, nil,
+	)
+)
+
+// indexRunningBuilds maps agent IDs to the builds running on them
+func indexRunningBuilds(builds *teamcity.Builds) map[int]teamcity.Build {
+	index := make(map[int]teamcity.Build)
+	for _, b := range builds.Builds {
+		index[b.Agent.ID] = b
+	}
+	return index
+}
+
+// agentPoolBusyTracker accumulates busy time of agent pools between refreshes,
+// assuming agents were busy since the last refresh if they are busy now
+type agentPoolBusyTracker struct {
+	mu         sync.Mutex
+	lastUpdate time.Time
+	seconds    map[string]float64
+}
+
+func newAgentPoolBusyTracker() *agentPoolBusyTracker {
+	return &agentPoolBusyTracker{
+		seconds: make(map[string]float64),
+	}
+}
+
+func (t *agentPoolBusyTracker) update(busyAgents map[string]int, now time.Time) map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := 0.0
+	if !t.lastUpdate.IsZero() {
+		elapsed = now.Sub(t.lastUpdate).Seconds()
+	}
+	for pool, count := range busyAgents {
+		t.seconds[pool] += float64(count) * elapsed
+	}
+	t.lastUpdate = now
+	seconds := make(map[string]float64, len(t.seconds))
+	for pool, s := range t.seconds {
+		seconds[pool] = s
+	}
+	return seconds
+}
+
+func (c *agentsCollector) collectAgentBuilds(ctx context.Context, ch chan<- prometheus.Metric, agents *teamcity.Agents, runningBuilds map[int]teamcity.Build) error {
+	now := time.Now()
+	busyAgents := make(map[string]int)
+	skipped := skippedItems{items: "running builds"}
+	for _, agent := range agents.Agents {
+		pool := agent.Pool.Name
+		b, found := runningBuilds[agent.ID]
+		if !found {
+			// pools without busy agents are exported too
+			busyAgents[pool] += 0
+			continue
+		}
+		busyAgents[pool]++
+
+		project, err := c.e.GetTopProject(ctx, b.BuildType.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		if len(b.StartDate) == 0 {
+			continue
+		}
+		started, err := teamcity.ParseTime(b.StartDate)
+		if err != nil {
+			logrus.Errorf("Can't parse start date of build %d: %s", b.ID, err)
+			skipped.skip(err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			agentRunningBuildElapsed, prometheus.GaugeValue, now.Sub(started).Seconds(),
+			agent.Name, pool, b.BuildType.ID, *project, b.BranchName)
+	}
+
+	for pool, seconds := range c.poolsBusy.update(busyAgents, now) {
+		ch <- prometheus.MustNewConstMetric(
+			agentPoolBusySeconds, prometheus.CounterValue, seconds, pool)
+	}
+	return skipped.err()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	agentPropertyFreeSpace = "teamcity.agent.work.dir.freeSpaceMb"
+	agentPropertyCPUCount  = "teamcity.agent.hardware.cpuCount"
+	agentPropertyMemory    = "teamcity.agent.hardware.memorySizeMb"
+
+	bytesInMegabyte = 1024 * 1024
+)
+
+var (
+	agentHardwareLabels = []string{"name", "pool"}
+
+	agentFreeDiskBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "free_disk_bytes"),
+		"Free space on the disk of the agent work directory",
+		agentHardwareLabels, nil,
+	)
+
+	agentCPUCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "cpu_count"),
+		"How many CPUs the agent has",
+		agentHardwareLabels, nil,
+	)
+
+	agentMemoryBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "memory_bytes"),
+		"How much memory the agent has",
+		agentHardwareLabels, nil,
+	)
+
+	agentPoolMinFreeDiskBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent_pool", "min_free_disk_bytes"),
+		"Least free space on the disk of an agent work directory in the pool",
+		[]string{"pool"}, nil,
+	)
+
+	agentPoolCPUCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent_pool", "cpu_count"),
+		"How many CPUs the agents of the pool have",
+		[]string{"pool"}, nil,
+	)
+
+	agentPoolMemoryBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent_pool", "memory_bytes"),
+		"How much memory the agents of the pool have",
+		[]string{"pool"}, nil,
+	)
+)
+
+type agentPoolHardware struct {
+	minFreeDisk float64
+	cpuCount    float64
+	memory      float64
+	hasFreeDisk bool
+	hasCPUCount bool
+	hasMemory   bool
+}
+
+// agentProperty returns the numeric value of the agent property scaled by factor
+func agentProperty(agent teamcity.Agent, name string, factor float64) (float64, bool) {
+	raw, found := agent.Properties[name]
+	if !found {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		logrus.Errorf("Can't parse property %s of agent %s: %s", name, agent.Name, err)
+		return 0, false
+	}
+	return value * factor, true
+}
+
+func collectAgentHardware(ch chan<- prometheus.Metric, agents *teamcity.Agents) {
+	pools := make(map[string]*agentPoolHardware)
+	for _, agent := range agents.Agents {
+		name, pool := agent.Name, agent.Pool.Name
+		p, found := pools[pool]
+		if !found {
+			p = &agentPoolHardware{}
+			pools[pool] = p
+		}
+		if freeDisk, ok := agentProperty(agent, agentPropertyFreeSpace, bytesInMegabyte); ok {
+			ch <- prometheus.MustNewConstMetric(
+				agentFreeDiskBytes, prometheus.GaugeValue, freeDisk, name, pool)
+			if !p.hasFreeDisk || freeDisk < p.minFreeDisk {
+				p.minFreeDisk = freeDisk
+			}
+			p.hasFreeDisk = true
+		}
+		if cpuCount, ok := agentProperty(agent, agentPropertyCPUCount, 1); ok {
+			ch <- prometheus.MustNewConstMetric(
+				agentCPUCount, prometheus.GaugeValue, cpuCount, name, pool)
+			p.cpuCount += cpuCount
+			p.hasCPUCount = true
+		}
+		if memory, ok := agentProperty(agent, agentPropertyMemory, bytesInMegabyte); ok {
+			ch <- prometheus.MustNewConstMetric(
+				agentMemoryBytes, prometheus.GaugeValue, memory, name, pool)
+			p.memory += memory
+			p.hasMemory = true
+		}
+	}
+
+	for pool, p := range pools {
+		if p.hasFreeDisk {
+			ch <- prometheus.MustNewConstMetric(
+				agentPoolMinFreeDiskBytes, prometheus.GaugeValue, p.minFreeDisk, pool)
+		}
+		if p.hasCPUCount {
+			ch <- prometheus.MustNewConstMetric(
+				agentPoolCPUCount, prometheus.GaugeValue, p.cpuCount, pool)
+		}
+		if p.hasMemory {
+			ch <- prometheus.MustNewConstMetric(
+				agentPoolMemoryBytes, prometheus.GaugeValue, p.memory, pool)
+		}
+	}
+}
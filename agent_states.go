@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	agentStateConnected    = "connected"
+	agentStateDisconnected = "disconnected"
+)
+
+var (
+	agentStateLabels = []string{"name", "pool"}
+
+	agentLastSeenConnected = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "last_seen_connected_timestamp_seconds"),
+		"When the agent was last seen connected by the exporter",
+		agentStateLabels, nil,
+	)
+
+	agentLastActivity = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "last_activity_timestamp_seconds"),
+		"When the agent was last active according to the TeamCity server",
+		agentStateLabels, nil,
+	)
+
+	agentDisconnections = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "disconnections_total"),
+		"How many times the agent was seen disconnecting by reason",
+		append(agentStateLabels, "reason"), nil,
+	)
+
+	agentStateSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "state_seconds_total"),
+		"How long the agent was seen in the state",
+		append(agentStateLabels, "state"), nil,
+	)
+
+	agentDisconnected = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "disconnected"),
+		"Whether the agent is disconnected by reason",
+		append(agentStateLabels, "reason"), nil,
+	)
+)
+
+// disconnectionReasons classifies disconnection comments by their substrings,
+// the first matching reason wins
+var disconnectionReasons = []struct {
+	reason     string
+	substrings []string
+}{
+	{"upgrade", []string{"upgrad", "update"}},
+	{"shutdown", []string{"shutdown", "shut down", "stopped", "stopping", "restart"}},
+	{"unregistered", []string{"unregister"}},
+	{"unreachable", []string{"unable to ping", "timed out", "timeout", "not responding", "unreachable"}},
+}
+
+func classifyDisconnection(comment string) string {
+	comment = strings.ToLower(comment)
+	if len(strings.TrimSpace(comment)) == 0 {
+		return "unknown"
+	}
+	for _, r := range disconnectionReasons {
+		for _, substring := range r.substrings {
+			if strings.Contains(comment, substring) {
+				return r.reason
+			}
+		}
+	}
+	return "other"
+}
+
+type agentState struct {
+	state             string
+	lastUpdate        time.Time
+	lastSeenConnected time.Time
+	disconnections    map[string]float64
+	stateSeconds      map[string]float64
+}
+
+// agentStateTracker remembers agent states between refreshes
+type agentStateTracker struct {
+	mu     sync.Mutex
+	agents map[int]*agentState
+}
+
+func newAgentStateTracker() *agentStateTracker {
+	return &agentStateTracker{
+		agents: make(map[int]*agentState),
+	}
+}
+
+// update records the current states of the agents, agents which no longer
+// exist are forgotten
+func (t *agentStateTracker) update(agents []teamcity.Agent, now time.Time) {
+	seen := make(map[int]bool)
+	for _, agent := range agents {
+		seen[agent.ID] = true
+		state := agentStateDisconnected
+		if agent.Connected {
+			state = agentStateConnected
+		}
+		s, found := t.agents[agent.ID]
+		if !found {
+			s = &agentState{
+				state:          state,
+				disconnections: make(map[string]float64),
+				stateSeconds:   make(map[string]float64),
+			}
+			t.agents[agent.ID] = s
+		} else {
+			s.stateSeconds[s.state] += now.Sub(s.lastUpdate).Seconds()
+			if s.state == agentStateConnected && state == agentStateDisconnected {
+				s.disconnections[classifyDisconnection(agent.DisconnectionComment)]++
+			}
+			s.state = state
+		}
+		s.lastUpdate = now
+		if agent.Connected {
+			s.lastSeenConnected = now
+		}
+	}
+	for id := range t.agents {
+		if !seen[id] {
+			delete(t.agents, id)
+		}
+	}
+}
+
+func (c *agentsCollector) collectAgentStates(ch chan<- prometheus.Metric, agents *teamcity.Agents) {
+	t := c.states
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.update(agents.Agents, time.Now())
+
+	for _, agent := range agents.Agents {
+		s := t.agents[agent.ID]
+		name, pool := agent.Name, agent.Pool.Name
+		if !s.lastSeenConnected.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				agentLastSeenConnected, prometheus.GaugeValue, float64(s.lastSeenConnected.Unix()), name, pool)
+		}
+		if len(agent.LastActivityTime) != 0 {
+			lastActivity, err := teamcity.ParseTime(agent.LastActivityTime)
+			if err != nil {
+				logrus.Errorf("Can't parse last activity time of agent %s: %s", name, err)
+			} else {
+				ch <- prometheus.MustNewConstMetric(
+					agentLastActivity, prometheus.GaugeValue, float64(lastActivity.Unix()), name, pool)
+			}
+		}
+		for reason, count := range s.disconnections {
+			ch <- prometheus.MustNewConstMetric(
+				agentDisconnections, prometheus.CounterValue, count, name, pool, reason)
+		}
+		for state, seconds := range s.stateSeconds {
+			ch <- prometheus.MustNewConstMetric(
+				agentStateSeconds, prometheus.CounterValue, seconds, name, pool, state)
+		}
+		if !agent.Connected {
+			ch <- prometheus.MustNewConstMetric(
+				agentDisconnected, prometheus.GaugeValue, 1, name, pool, classifyDisconnection(agent.DisconnectionComment))
+		}
+	}
+}
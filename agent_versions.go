@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	agentVersionCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "version_count"),
+		"How many agents by version and upgrade state",
+		[]string{"pool", "os", "version", "plugins_version", "uptodate", "upgrading"}, nil,
+	)
+
+	agentOutdatedCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "agent", "outdated_count"),
+		"How many agents run a version different from the TeamCity server",
+		[]string{"pool", "os"}, nil,
+	)
+
+	serverBuildNumberRegexp = regexp.MustCompile(`\(build (\d+)\)`)
+)
+
+type agentVersionKey struct {
+	pool           string
+	os             string
+	version        string
+	pluginsVersion string
+	upToDate       bool
+	upgrading      bool
+}
+
+// serverBuildNumber returns the build number of the TeamCity server agents
+// report as their version, e.g. 47175 for "2017.1.5 (build 47175)"
+func serverBuildNumber(server *teamcity.Server) string {
+	if len(server.BuildNumber) != 0 {
+		return server.BuildNumber
+	}
+	if m := serverBuildNumberRegexp.FindStringSubmatch(server.Version); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func collectAgentVersions(ch chan<- prometheus.Metric, agents *teamcity.Agents, server *teamcity.Server) {
+	buildNumber := serverBuildNumber(server)
+	versionCounts := make(map[agentVersionKey]int)
+	outdatedCounts := make(map[[2]string]int)
+	for _, agent := range agents.Agents {
+		pool, os := agent.Pool.Name, agentOS(agent)
+		versionCounts[agentVersionKey{
+			pool:           pool,
+			os:             os,
+			version:        agent.Version,
+			pluginsVersion: agent.PluginsVersion,
+			upToDate:       agent.UpToDate,
+			upgrading:      agent.Upgrading,
+		}]++
+		key := [2]string{pool, os}
+		if _, found := outdatedCounts[key]; !found {
+			outdatedCounts[key] = 0
+		}
+		if len(buildNumber) != 0 && len(agent.Version) != 0 && agent.Version != buildNumber {
+			outdatedCounts[key]++
+		}
+	}
+
+	for key, count := range versionCounts {
+		ch <- prometheus.MustNewConstMetric(
+			agentVersionCount, prometheus.GaugeValue, float64(count), key.pool, key.os, key.version, key.pluginsVersion,
+			strconv.FormatBool(key.upToDate), strconv.FormatBool(key.upgrading))
+	}
+	if len(buildNumber) == 0 {
+		return
+	}
+	for key, count := range outdatedCounts {
+		ch <- prometheus.MustNewConstMetric(
+			agentOutdatedCount, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	agentLabels = []string{"name", "pool", "os", "enabled", "authorized", "connected", "project", "busy"}
+
+	agentInfoCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agent_type_count"),
+		"How many agents by metadata",
+		agentLabels, nil,
+	)
+)
+
+func init() {
+	registerCollector("agents", true, 0, priorityHigh, newAgentsCollector)
+}
+
+type agentsCollector struct {
+	e         *Exporter
+	states    *agentStateTracker
+	poolsBusy *agentPoolBusyTracker
+}
+
+func newAgentsCollector(e *Exporter) Collector {
+	return &agentsCollector{
+		e:         e,
+		states:    newAgentStateTracker(),
+		poolsBusy: newAgentPoolBusyTracker(),
+	}
+}
+
+func agentOS(agent teamcity.Agent) string {
+	if _, ok := agent.Properties["system.feature.windows.version"]; ok {
+		return "Windows"
+	} else if _, ok := agent.Properties["system.feature.linux.version"]; ok {
+		return "Linux"
+	}
+	return "Other"
+}
+
+func (c *agentsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	server, err := e.serverFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	allAgents, err := e.client.GetAgents(ctx)
+	if err != nil {
+		return err
+	}
+	runningBuilds, err := e.client.GetRunningBuilds(ctx)
+	if err != nil {
+		return err
+	}
+
+	var agentInfo map[string]map[string]map[string]map[string]map[string]map[string]map[string]map[string]int
+	agentInfo = make(map[string]map[string]map[string]map[string]map[string]map[string]map[string]map[string]int)
+
+	var runningAgents = indexRunningBuilds(runningBuilds)
+
+	for _, agent := range allAgents.Agents {
+
+		var name = agent.Name
+		var pool = agent.Pool.Name
+		var agentos = agentOS(agent)
+		var enabled = strconv.FormatBool(agent.EnabledInfo.Status)
+		var authorized = strconv.FormatBool(agent.AuthorizedInfo.Status)
+		var connected = strconv.FormatBool(agent.Connected)
+		var busy = strconv.FormatBool(false)
+		var project = ""
+		if b, found := runningAgents[agent.ID]; found {
+			busy = strconv.FormatBool(true)
+			if tmpproj, err := e.GetTopProject(ctx, b.BuildType.ProjectID); err != nil {
+				logrus.Errorf("Cant get project info: %s", err)
+			} else {
+				project = *tmpproj
+			}
+		}
+		logrus.Debugf("project: %s", project)
+
+		if _, found := agentInfo[name]; !found {
+			agentInfo[name] = make(map[string]map[string]map[string]map[string]map[string]map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool]; !found {
+			agentInfo[name][pool] = make(map[string]map[string]map[string]map[string]map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos]; !found {
+			agentInfo[name][pool][agentos] = make(map[string]map[string]map[string]map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos][enabled]; !found {
+			agentInfo[name][pool][agentos][enabled] = make(map[string]map[string]map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos][enabled][authorized]; !found {
+			agentInfo[name][pool][agentos][enabled][authorized] = make(map[string]map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos][enabled][authorized][connected]; !found {
+			agentInfo[name][pool][agentos][enabled][authorized][connected] = make(map[string]map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos][enabled][authorized][connected][project]; !found {
+			agentInfo[name][pool][agentos][enabled][authorized][connected][project] = make(map[string]int)
+		}
+		if _, found := agentInfo[pool][agentos][enabled][authorized][connected][project][busy]; !found {
+			agentInfo[name][pool][agentos][enabled][authorized][connected][project][busy] = 0
+		}
+		agentInfo[name][pool][agentos][enabled][authorized][connected][project][busy]++
+	}
+
+	for name, poolmap := range agentInfo {
+		for poolname, osmap := range poolmap {
+			for osname, enabledmap := range osmap {
+				for enabled, authorizedmap := range enabledmap {
+					for authorized, connectedmap := range authorizedmap {
+						for connected, projectmap := range connectedmap {
+							for project, busymap := range projectmap {
+								for busy, count := range busymap {
+									ch <- prometheus.MustNewConstMetric(
+										agentInfoCount, prometheus.GaugeValue, float64(count), name, poolname, osname, enabled, authorized, connected, project, busy)
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	c.collectAgentStates(ch, allAgents)
+	collectAgentVersions(ch, allAgents, server)
+	collectAgentHardware(ch, allAgents)
+	return c.collectAgentBuilds(ctx, ch, allAgents, runningAgents)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const exporterSubsystem = "exporter"
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_requests_total",
+		Help:      "How many requests to the TeamCity API were made by endpoint and status code",
+	}, []string{"endpoint", "code"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_request_duration_seconds",
+		Help:      "How long requests to the TeamCity API took by endpoint, including reading the response",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	apiResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_response_size_bytes",
+		Help:      "Size of responses of the TeamCity API by endpoint",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"endpoint"})
+
+	decodeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "decode_errors_total",
+		Help:      "How many responses of the TeamCity API could not be decoded by endpoint",
+	}, []string{"endpoint"})
+
+	apiRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_retries_total",
+		Help:      "How many requests to the TeamCity API were retried by endpoint",
+	}, []string{"endpoint"})
+
+	apiBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_circuit_breaker_state",
+		Help:      "Current state (closed, open or half_open) of the TeamCity API circuit breaker",
+	}, []string{"state"})
+
+	apiDeferredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "api_requests_deferred_total",
+		Help:      "How many requests to the TeamCity API were deferred by the request budget by endpoint and priority",
+	}, []string{"endpoint", "priority"})
+)
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiRequestDuration, apiResponseSize, decodeErrors,
+		apiRetries, apiBreakerState, apiDeferredRequests)
+}
+
+func observeRequest(endpoint string, code int) {
+	apiRequests.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+}
+
+func observeRequestError(endpoint string, start time.Time) {
+	apiRequests.WithLabelValues(endpoint, "error").Inc()
+	apiRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedBody observes duration and size of the response once it is
+// closed, canceling the context of the request then
+type instrumentedBody struct {
+	io.ReadCloser
+	endpoint string
+	start    time.Time
+	cancel   context.CancelFunc
+	size     int
+	closed   bool
+}
+
+func (b *instrumentedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	return n, err
+}
+
+func (b *instrumentedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		apiRequestDuration.WithLabelValues(b.endpoint).Observe(time.Since(b.start).Seconds())
+		apiResponseSize.WithLabelValues(b.endpoint).Observe(float64(b.size))
+	}
+	err := b.ReadCloser.Close()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	auditEventsTotal = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "audit", "events_total"),
+		"How many audit events were recorded by action and project",
+		[]string{"action", "project"}, nil,
+	)
+)
+
+type auditKey struct {
+	action  string
+	project string
+}
+
+// auditTracker counts audit events newer than the watermark, which is the
+// ID of the latest event seen
+type auditTracker struct {
+	mu          sync.Mutex
+	initialized bool
+	lastID      int
+	counts      map[auditKey]float64
+}
+
+func newAuditTracker() *auditTracker {
+	return &auditTracker{
+		counts: make(map[auditKey]float64),
+	}
+}
+
+func auditAction(event teamcity.AuditEvent) string {
+	if len(event.Action.Name) != 0 {
+		return event.Action.Name
+	}
+	return event.Action.ID
+}
+
+// auditProject returns the ID of the project the event relates to, if any
+func auditProject(event teamcity.AuditEvent) string {
+	for _, entity := range event.RelatedEntities.Entities {
+		if len(entity.Project.ID) != 0 {
+			return entity.Project.ID
+		}
+		if len(entity.BuildType.ProjectID) != 0 {
+			return entity.BuildType.ProjectID
+		}
+	}
+	return ""
+}
+
+func init() {
+	registerCollector("audit", true, 0, priorityNormal, newAuditCollector)
+}
+
+type auditCollector struct {
+	e       *Exporter
+	tracker *auditTracker
+}
+
+func newAuditCollector(e *Exporter) Collector {
+	return &auditCollector{
+		e:       e,
+		tracker: newAuditTracker(),
+	}
+}
+
+func (c *auditCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	t := c.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// events recorded before the exporter started are not counted, so only
+	// the latest one is requested to set the watermark
+	limit := auditEventsLimit
+	if !t.initialized {
+		limit = 1
+	}
+	events, err := c.e.client.GetAuditEvents(ctx, t.lastID, limit)
+	if err != nil {
+		return err
+	}
+
+	lastID := t.lastID
+	for _, event := range events.Events {
+		if event.ID > lastID {
+			lastID = event.ID
+		}
+		if !t.initialized {
+			continue
+		}
+		project := auditProject(event)
+		if len(project) != 0 {
+			// deleted projects can't be resolved and are reported as is
+			if topProject, err := c.e.GetTopProject(ctx, project); err == nil {
+				project = *topProject
+			}
+		}
+		t.counts[auditKey{action: auditAction(event), project: project}]++
+	}
+	if t.initialized && len(events.Events) == auditEventsLimit {
+		logrus.Warnf("More than %d audit events since the last scrape, events older than %d were not counted",
+			auditEventsLimit, events.Events[len(events.Events)-1].ID)
+	}
+	t.lastID = lastID
+	t.initialized = true
+
+	for key, count := range t.counts {
+		ch <- prometheus.MustNewConstMetric(
+			auditEventsTotal, prometheus.CounterValue, count, key.action, key.project)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	buildStatisticLabels = []string{"build_type", "key"}
+
+	buildStatisticLastValue = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build", "statistic_last_value"),
+		"Value of the build statistic of the latest finished build of the build type",
+		buildStatisticLabels, nil,
+	)
+)
+
+// buildStatisticsTracker remembers the latest finished build seen per build
+// type, so statistics of every build are observed only once
+type buildStatisticsTracker struct {
+	mu         sync.Mutex
+	lastBuilds map[string]int
+	lastValues map[[2]string]float64
+	histogram  *prometheus.HistogramVec
+}
+
+func newBuildStatisticsTracker(buckets []float64) *buildStatisticsTracker {
+	return &buildStatisticsTracker{
+		lastBuilds: make(map[string]int),
+		lastValues: make(map[[2]string]float64),
+		histogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "build",
+			Name:      "statistic_value",
+			Help:      "Values of the build statistic of finished builds of the build type",
+			Buckets:   buckets,
+		}, buildStatisticLabels),
+	}
+}
+
+func (t *buildStatisticsTracker) observe(buildTypeID string, key buildStatisticKey, value float64) {
+	if key.histogram {
+		t.histogram.WithLabelValues(buildTypeID, key.name).Observe(value)
+		return
+	}
+	t.lastValues[[2]string{buildTypeID, key.name}] = value
+}
+
+func init() {
+	registerCollector("build_statistics", false, 0, priorityLow, newBuildStatisticsCollector)
+}
+
+type buildStatisticsCollector struct {
+	e       *Exporter
+	tracker *buildStatisticsTracker
+}
+
+func newBuildStatisticsCollector(e *Exporter) Collector {
+	return &buildStatisticsCollector{
+		e:       e,
+		tracker: newBuildStatisticsTracker(e.config.buildStatisticsBuckets),
+	}
+}
+
+func (c *buildStatisticsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	t := c.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	skipped := skippedItems{items: "build types"}
+	for _, buildTypeID := range e.config.buildStatisticsBuildTypes {
+		builds, err := e.client.GetFinishedBuildsOfType(ctx, buildTypeID, t.lastBuilds[buildTypeID], buildStatisticsBacklogLimit)
+		if err != nil {
+			logrus.Errorf("Can't get finished builds of %s: %s", buildTypeID, err)
+			skipped.skip(err)
+			continue
+		}
+		if len(builds.Builds) == buildStatisticsBacklogLimit {
+			logrus.Warnf("More than %d builds of %s finished since the last observed one, builds older than %d were not observed",
+				buildStatisticsBacklogLimit, buildTypeID, builds.Builds[len(builds.Builds)-1].ID)
+		}
+		// builds are ordered from the newest one, statistics are observed
+		// from the oldest one so the latest values win. The watermark moves
+		// by up to buildStatisticsLimit builds, later ones are observed on
+		// the next refreshes.
+		first := len(builds.Builds) - 1
+		last := 0
+		if len(builds.Builds) > buildStatisticsLimit {
+			last = len(builds.Builds) - buildStatisticsLimit
+			logrus.Infof("Observing statistics of %d of %d new builds of %s, the rest is left for the next refreshes",
+				buildStatisticsLimit, len(builds.Builds), buildTypeID)
+		}
+		for i := first; i >= last; i-- {
+			b := builds.Builds[i]
+			statistics, err := e.client.GetBuildStatistics(ctx, b.ID)
+			if err != nil {
+				logrus.Errorf("Can't get statistics of build %d: %s", b.ID, err)
+				skipped.skip(err)
+				break
+			}
+			for _, key := range e.config.buildStatisticsKeys {
+				raw, found := (*statistics)[key.name]
+				if !found {
+					continue
+				}
+				value, err := strconv.ParseFloat(raw, 64)
+				if err != nil {
+					logrus.Errorf("Can't parse statistic %s of build %d: %s", key.name, b.ID, err)
+					continue
+				}
+				t.observe(buildTypeID, key, value)
+			}
+			t.lastBuilds[buildTypeID] = b.ID
+		}
+	}
+
+	for key, value := range t.lastValues {
+		ch <- prometheus.MustNewConstMetric(
+			buildStatisticLastValue, prometheus.GaugeValue, value, key[0], key[1])
+	}
+	t.histogram.Collect(ch)
+	return skipped.err()
+}
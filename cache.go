@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxCacheEntries bounds the response cache, it is emptied once exceeded
+const maxCacheEntries = 10000
+
+// cacheResources are the slow-changing resources responses of which may be
+// cached, matched by the prefix of the route
+var cacheResources = []struct {
+	name   string
+	prefix string
+}{
+	{"projects", "app/rest/projects/"},
+	{"build_types", "app/rest/buildTypes"},
+	{"compatible_agents", "app/rest/agents?locator=compatible:"},
+}
+
+var (
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "cache_hits_total",
+		Help:      "How many responses of the TeamCity API were served from the cache by resource",
+	}, []string{"resource"})
+
+	cacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "cache_misses_total",
+		Help:      "How many responses of the TeamCity API were not found in the cache by resource",
+	}, []string{"resource"})
+
+	cacheRevalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: exporterSubsystem,
+		Name:      "cache_revalidations_total",
+		Help:      "How many expired responses were confirmed unchanged by TeamCity by resource",
+	}, []string{"resource"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits, cacheMisses, cacheRevalidations)
+}
+
+func cacheResource(route string) string {
+	for _, r := range cacheResources {
+		if strings.HasPrefix(route, r.prefix) {
+			return r.name
+		}
+	}
+	return ""
+}
+
+type cacheEntry struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// responseCache keeps responses of slow-changing resources for their TTL
+// and revalidates expired ones with If-None-Match where TeamCity returned
+// an ETag
+type responseCache struct {
+	mu      sync.Mutex
+	ttls    map[string]time.Duration
+	entries map[string]*cacheEntry
+}
+
+func newResponseCache(ttls map[string]time.Duration) *responseCache {
+	return &responseCache{
+		ttls:    ttls,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// lookup returns the resource and TTL of the route, an empty resource if
+// responses of the route are not cached
+func (c *responseCache) lookup(route string) (string, time.Duration) {
+	resource := cacheResource(route)
+	ttl := c.ttls[resource]
+	if ttl <= 0 {
+		return "", 0
+	}
+	return resource, ttl
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[key]
+}
+
+func (c *responseCache) put(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[key]; !found && len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	c.entries[key] = entry
+}
+
+// cachingTransport serves responses of slow-changing resources from the
+// cache, so fresh responses don't count against the request budget
+type cachingTransport struct {
+	config *Config
+	cache  *responseCache
+	next   http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resource, ttl := t.cache.lookup(apiRoute(t.config, req.URL))
+	if len(resource) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	key := req.URL.String()
+	entry := t.cache.get(key)
+	if entry != nil && time.Now().Before(entry.expires) {
+		cacheHits.WithLabelValues(resource).Inc()
+		return cachedResponse(req, entry.body), nil
+	}
+	if entry != nil && len(entry.etag) != 0 {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		resp.Body.Close()
+		cacheRevalidations.WithLabelValues(resource).Inc()
+		t.cache.put(key, &cacheEntry{body: entry.body, etag: entry.etag, expires: time.Now().Add(ttl)})
+		return cachedResponse(req, entry.body), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	cacheMisses.WithLabelValues(resource).Inc()
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	t.cache.put(key, &cacheEntry{body: body, etag: resp.Header.Get("ETag"), expires: time.Now().Add(ttl)})
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// cachedResponse returns a 200 response of the request with the body
+func cachedResponse(req *http.Request, body []byte) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TeamCity is the part of the TeamCity API the collectors use, implemented
+// by *teamcity.Client
+type TeamCity interface {
+	GetServer(ctx context.Context) (*teamcity.Server, error)
+	GetLicensingData(ctx context.Context) (*teamcity.LicensingData, error)
+	GetBuildQueue(ctx context.Context) (*teamcity.BuildQueue, error)
+	GetCompatibleAgents(ctx context.Context, buildID int) (*teamcity.Agents, error)
+	GetAgents(ctx context.Context) (*teamcity.Agents, error)
+	GetRunningBuilds(ctx context.Context) (*teamcity.Builds, error)
+	GetFinishedBuilds(ctx context.Context, since time.Time, limit int) (*teamcity.Builds, error)
+	GetFinishedBuildsOfType(ctx context.Context, buildTypeID string, sinceID int, limit int) (*teamcity.Builds, error)
+	GetBuildStatistics(ctx context.Context, id int) (*teamcity.Properties, error)
+	GetVcsRootInstances(ctx context.Context) (*teamcity.VcsRootInstances, error)
+	GetBuildTypes(ctx context.Context) (*teamcity.BuildTypes, error)
+	GetPendingChanges(ctx context.Context, buildTypeID string) (*teamcity.Changes, error)
+	GetServerMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error)
+	GetUsers(ctx context.Context) (*teamcity.Users, error)
+	GetAuditEvents(ctx context.Context, sinceID, limit int) (*teamcity.AuditEvents, error)
+	GetProject(ctx context.Context, id string) (*teamcity.Project, error)
+}
+
+// newClient returns the TeamCity client of the exporter. Responses of slow
+// changing resources are cached, other requests are limited by the budget,
+// circuit breaker and rate limit and retried on failure.
+func newClient(config *Config, budget *requestBudget) *teamcity.Client {
+	client := teamcity.NewClient(config.apiEndpointUrl, config.apiLogin, config.apiPassword)
+	client.HTTPClient = &http.Client{
+		Transport: &cachingTransport{
+			config: config,
+			cache:  newResponseCache(config.cacheTTLs),
+			next: &apiTransport{
+				config:  config,
+				breaker: newCircuitBreaker(config.apiBreakerThreshold, config.apiBreakerCooldown),
+				limiter: newTokenBucket(config.apiRateLimit, config.apiRateBurst),
+				budget:  budget,
+				next:    newTransport(config),
+			},
+		},
+	}
+	client.UserAgent = config.apiUserAgent
+	client.PageSize = config.apiPageSize
+	client.OnDecodeError = func(err *teamcity.DecodeError) {
+		decodeErrors.WithLabelValues(err.Endpoint).Inc()
+	}
+	return client
+}
+
+// apiRoute returns the route of the request URL relative to the API URL,
+// e.g. app/rest/agents?locator=authorized:any
+func apiRoute(config *Config, u *url.URL) string {
+	route := strings.TrimPrefix(u.Path, "/")
+	prefix := strings.Trim(config.apiEndpointUrl.Path, "/")
+	if len(prefix) != 0 && strings.HasPrefix(route, prefix+"/") {
+		route = strings.TrimPrefix(route, prefix+"/")
+	}
+	if len(u.RawQuery) != 0 {
+		route += "?" + u.RawQuery
+	}
+	return route
+}
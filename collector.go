@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	collectorSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "success"),
+		"Whether the last update of the collector was successful",
+		[]string{"collector"}, nil,
+	)
+
+	collectorDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "collector", "duration_seconds"),
+		"How long the last update of the collector took",
+		[]string{"collector"}, nil,
+	)
+)
+
+// Collector collects metrics of one area of TeamCity independently of others
+type Collector interface {
+	// Update sends the metrics of the collector to ch, requesting TeamCity
+	// with ctx
+	Update(ctx context.Context, ch chan<- prometheus.Metric) error
+}
+
+// collectorRegistration describes a collector known to the exporter and the
+// flags it can be enabled, disabled and scheduled with
+type collectorRegistration struct {
+	defaultEnabled  bool
+	defaultInterval time.Duration
+	priority        requestPriority
+	factory         func(e *Exporter) Collector
+
+	enableFlag   *bool
+	disableFlag  *bool
+	intervalFlag *time.Duration
+}
+
+var collectorRegistry = make(map[string]*collectorRegistration)
+
+// registerCollector makes the collector available under the name, it must be
+// called from init so flags are defined before they are parsed
+func registerCollector(name string, defaultEnabled bool, defaultInterval time.Duration, priority requestPriority, factory func(e *Exporter) Collector) {
+	if _, found := collectorRegistry[name]; found {
+		panic(fmt.Sprintf("collector %s is already registered", name))
+	}
+	collectorRegistry[name] = &collectorRegistration{
+		defaultEnabled:  defaultEnabled,
+		defaultInterval: defaultInterval,
+		priority:        priority,
+		factory:         factory,
+		enableFlag: flag.Bool("collector."+name, defaultEnabled,
+			fmt.Sprintf("Enable the %s collector", name)),
+		disableFlag: flag.Bool("no-collector."+name, false,
+			fmt.Sprintf("Disable the %s collector", name)),
+		intervalFlag: flag.Duration("collector."+name+".interval", defaultInterval,
+			fmt.Sprintf("How often the %s collector is refreshed, 0 refreshes it on every scrape", name)),
+	}
+}
+
+// registeredCollectors returns names of all registered collectors sorted
+func registeredCollectors() []string {
+	names := make([]string, 0, len(collectorRegistry))
+	for name := range collectorRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scheduledCollector updates the wrapped collector only once the interval has
+// passed, sending metrics of the last successful update in between
+type scheduledCollector struct {
+	collector Collector
+	metrics   *scheduledMetrics
+}
+
+func newScheduledCollector(collector Collector, interval time.Duration) Collector {
+	return &scheduledCollector{
+		collector: collector,
+		metrics:   newScheduledMetrics(interval),
+	}
+}
+
+func (c *scheduledCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return c.metrics.collect(ch, func(ch chan<- prometheus.Metric) error {
+		return c.collector.Update(ctx, ch)
+	})
+}
+
+// prioritizedCollector updates the wrapped collector making its requests
+// with the priority
+type prioritizedCollector struct {
+	collector Collector
+	priority  requestPriority
+}
+
+func newPrioritizedCollector(collector Collector, priority requestPriority) Collector {
+	return &prioritizedCollector{
+		collector: collector,
+		priority:  priority,
+	}
+}
+
+func (c *prioritizedCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return c.collector.Update(withPriority(ctx, c.priority), ch)
+}
+
+// collectAll updates the collectors concurrently, so one collector failing
+// or being slow never affects the others
+func collectAll(ctx context.Context, collectors map[string]Collector, ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	wg.Add(len(collectors))
+	for name, c := range collectors {
+		go func(name string, c Collector) {
+			execute(ctx, name, c, ch)
+			wg.Done()
+		}(name, c)
+	}
+	wg.Wait()
+}
+
+// skippedItems counts items a collector skipped on errors while sending
+// metrics of the others, so partial metrics fail the update
+type skippedItems struct {
+	items string
+	count int
+	last  error
+}
+
+func (s *skippedItems) skip(err error) {
+	s.count++
+	s.last = err
+}
+
+// err returns an error of the update if any item was skipped
+func (s *skippedItems) err() error {
+	if s.count == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d %s were skipped, the last one on: %v", s.count, s.items, s.last)
+}
+
+// recoverUpdate updates the collector turning a panic into its error, so one
+// collector panicking never stops the exporter
+func recoverUpdate(ctx context.Context, name string, c Collector, ch chan<- prometheus.Metric) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Collector %s panicked: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("Collector panicked: %v", r)
+		}
+	}()
+	return c.Update(ctx, ch)
+}
+
+func execute(ctx context.Context, name string, c Collector, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	err := recoverUpdate(ctx, name, c, ch)
+	duration := time.Since(start)
+
+	success := 1.0
+	if err != nil {
+		logrus.Errorf("Collector %s failed after %s: %s", name, duration, err)
+		success = 0
+	} else {
+		logrus.Debugf("Collector %s succeeded after %s", name, duration)
+	}
+	ch <- prometheus.MustNewConstMetric(collectorDuration, prometheus.GaugeValue, duration.Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(collectorSuccess, prometheus.GaugeValue, success, name)
+}
@@ -1,25 +1,155 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
 )
 
 type Config struct {
 	listenAddress  string
 	metricPath     string
+	scrapeTimeout  time.Duration
+	webConfigFile  string
+	webConfig      *webConfig
+	webTLSConfig   *tls.Config
 	apiLogin       string
 	apiPassword    string
 	apiEndpoint    string
 	apiEndpointUrl *url.URL
+
+	apiTimeout time.Duration
+	// apiPageSize is the count of items per page of paginated collections
+	apiPageSize        int
+	apiRetries         int
+	apiRetryBackoff    time.Duration
+	apiRetryMaxBackoff time.Duration
+	// apiBreakerThreshold of consecutive failures opens the circuit breaker,
+	// 0 disables it
+	apiBreakerThreshold int
+	apiBreakerCooldown  time.Duration
+	// apiRateLimit in requests per second, 0 disables it
+	apiRateLimit float64
+	apiRateBurst int
+	// apiRequestBudget limits requests per refresh, 0 disables it
+	apiRequestBudget int
+
+	apiCAFile             string
+	apiCertFile           string
+	apiKeyFile            string
+	apiServerName         string
+	apiTLSMinVersion      string
+	apiInsecureSkipVerify bool
+	apiTLSConfig          *tls.Config
+	apiProxy              string
+	apiProxyFunc          func(*http.Request) (*url.URL, error)
+	apiUserAgent          string
+
+	// cacheTTLs maps cached resources to how long their responses are kept
+	cacheTTLs map[string]time.Duration
+
+	// collectors maps names of registered collectors to their settings
+	collectors map[string]*collectorConfig
+
+	// userTeams maps TeamCity usernames to team names
+	userTeams            map[string]string
+	finishedBuildsWindow time.Duration
+	dependencyTopRoots   int
+
+	// vcsRootStaleAfter is how long after its last check for changes a
+	// polling VCS root is reported as stale, 0 disables it
+	vcsRootStaleAfter time.Duration
+
+	pendingChangesMaxBuildTypes int
+	// pendingChangesBuildTypes limits build types checked for pending changes
+	pendingChangesBuildTypes *regexp.Regexp
+
+	// serverMetrics maps storage metrics to metric names of the TeamCity
+	// server, only mapped storage metrics are exported
+	serverMetrics map[string]string
+
+	// usersActiveDays are the periods users are counted as active within
+	usersActiveDays []int
+
+	// buildStatisticsBuildTypes enables build statistics for the build types
+	buildStatisticsBuildTypes []string
+	buildStatisticsKeys       []buildStatisticKey
+	buildStatisticsBuckets    []float64
+}
+
+type collectorConfig struct {
+	enabled bool
+	// interval of 0 refreshes the collector on every scrape
+	interval time.Duration
+}
+
+type buildStatisticKey struct {
+	name      string
+	histogram bool
 }
 
 func NewConfig() *Config {
+	collectors := make(map[string]*collectorConfig)
+	for name, r := range collectorRegistry {
+		collectors[name] = &collectorConfig{
+			enabled:  r.defaultEnabled,
+			interval: r.defaultInterval,
+		}
+	}
 	return &Config{
 		listenAddress: ":9190",
 		metricPath:    "/metrics",
+		scrapeTimeout: 30 * time.Second,
+
+		apiTimeout:          10 * time.Second,
+		apiPageSize:         100,
+		apiRetries:          3,
+		apiRetryBackoff:     500 * time.Millisecond,
+		apiRetryMaxBackoff:  10 * time.Second,
+		apiBreakerThreshold: 5,
+		apiBreakerCooldown:  30 * time.Second,
+		apiRateLimit:        20,
+		apiRateBurst:        40,
+		apiTLSMinVersion:    "1.2",
+		apiUserAgent:        userAgent(),
+
+		cacheTTLs: map[string]time.Duration{
+			"projects":          10 * time.Minute,
+			"build_types":       5 * time.Minute,
+			"compatible_agents": time.Minute,
+		},
+
+		collectors: collectors,
+
+		userTeams:            make(map[string]string),
+		finishedBuildsWindow: time.Hour,
+		dependencyTopRoots:   10,
+
+		vcsRootStaleAfter: time.Hour,
+
+		pendingChangesMaxBuildTypes: 100,
+
+		serverMetrics: make(map[string]string),
+
+		usersActiveDays: []int{1, 7, 30},
+
+		buildStatisticsKeys: []buildStatisticKey{
+			{name: "BuildDurationNetTime"},
+			{name: "TimeSpentInQueue"},
+			{name: "ArtifactsSize"},
+		},
+		buildStatisticsBuckets: prometheus.ExponentialBuckets(1000, 2, 12),
 	}
 }
 
@@ -27,12 +157,18 @@ func (c *Config) Load() error {
 	if err := c.LoadFromEnv(); err != nil {
 		return err
 	}
+	if err := c.LoadFromFlags(); err != nil {
+		return err
+	}
 	if len(c.listenAddress) == 0 {
 		return errors.New("Listen address must be defined")
 	}
 	if len(c.metricPath) == 0 {
 		return errors.New("Metric path must be defined")
 	}
+	if c.scrapeTimeout <= 0 {
+		return errors.New("Scrape timeout must be positive")
+	}
 	if len(c.apiLogin) == 0 {
 		return errors.New("API login must be defined")
 	}
@@ -42,11 +178,104 @@ func (c *Config) Load() error {
 	if len(c.apiEndpoint) == 0 {
 		return errors.New("API URL must be defined")
 	}
+	if c.apiTimeout <= 0 {
+		return errors.New("API timeout must be positive")
+	}
+	if c.apiPageSize <= 0 {
+		return errors.New("API page size must be positive")
+	}
+	if c.apiRetries < 0 {
+		return errors.New("API retries must not be negative")
+	}
+	if c.apiRetryBackoff <= 0 {
+		return errors.New("API retry backoff must be positive")
+	}
+	if c.apiRetryMaxBackoff < c.apiRetryBackoff {
+		return errors.New("API retry max backoff must not be less than API retry backoff")
+	}
+	if c.apiBreakerThreshold < 0 {
+		return errors.New("API breaker threshold must not be negative")
+	}
+	if c.apiBreakerCooldown <= 0 {
+		return errors.New("API breaker cooldown must be positive")
+	}
+	if c.apiRateLimit < 0 {
+		return errors.New("API rate limit must not be negative")
+	}
+	if c.apiRateLimit > 0 && c.apiRateBurst <= 0 {
+		return errors.New("API rate burst must be positive")
+	}
+	if c.apiRequestBudget < 0 {
+		return errors.New("API request budget must not be negative")
+	}
+	if c.finishedBuildsWindow <= 0 {
+		return errors.New("Finished builds window must be positive")
+	}
+	if c.dependencyTopRoots < 0 {
+		return errors.New("Dependency top roots must not be negative")
+	}
+	if c.vcsRootStaleAfter < 0 {
+		return errors.New("VCS root stale after must not be negative")
+	}
+	if c.pendingChangesMaxBuildTypes < 0 {
+		return errors.New("Pending changes max build types must not be negative")
+	}
+	for name, collector := range c.collectors {
+		if collector.interval < 0 {
+			return fmt.Errorf("Interval of the %s collector must not be negative", name)
+		}
+	}
+	if c.collectors["build_statistics"].enabled && len(c.buildStatisticsBuildTypes) == 0 {
+		return errors.New("Build statistics collector requires build types to be defined")
+	}
+	if c.collectors["server_storage"].enabled && len(c.serverMetrics) == 0 {
+		return errors.New("Server storage collector requires server metrics to be defined")
+	}
+	usersActiveDays := make(map[int]bool)
+	for _, days := range c.usersActiveDays {
+		if days <= 0 {
+			return errors.New("Users active days must be positive")
+		}
+		if usersActiveDays[days] {
+			return errors.New("Users active days must be unique")
+		}
+		usersActiveDays[days] = true
+	}
+	buildStatisticsKeys := make(map[buildStatisticKey]bool)
+	for _, key := range c.buildStatisticsKeys {
+		if buildStatisticsKeys[key] {
+			return errors.New("Build statistics keys must be unique")
+		}
+		buildStatisticsKeys[key] = true
+	}
+	for i := 1; i < len(c.buildStatisticsBuckets); i++ {
+		if c.buildStatisticsBuckets[i] <= c.buildStatisticsBuckets[i-1] {
+			return errors.New("Build statistics buckets must be in increasing order")
+		}
+	}
 	u, err := url.Parse(c.apiEndpoint)
 	if err != nil {
 		return fmt.Errorf("Can't parse API URL: %v", err)
 	}
 	c.apiEndpointUrl = u
+	if err := c.loadTLSConfig(); err != nil {
+		return err
+	}
+	if err := c.loadProxy(); err != nil {
+		return err
+	}
+	if len(c.webConfigFile) != 0 {
+		wc, err := loadWebConfig(c.webConfigFile)
+		if err != nil {
+			return fmt.Errorf("Can't load web config file: %v", err)
+		}
+		webTLSConfig, err := wc.serverTLSConfig()
+		if err != nil {
+			return fmt.Errorf("Can't load web config file: %v", err)
+		}
+		c.webConfig = wc
+		c.webTLSConfig = webTLSConfig
+	}
 	return nil
 }
 
@@ -59,6 +288,13 @@ func (c *Config) LoadFromEnv() error {
 	if len(metricPathRaw) != 0 {
 		c.metricPath = metricPathRaw
 	}
+	if err := durationFromEnv("TE_SCRAPE_TIMEOUT", &c.scrapeTimeout); err != nil {
+		return err
+	}
+	webConfigFileRaw := os.Getenv("TE_WEB_CONFIG_FILE")
+	if len(webConfigFileRaw) != 0 {
+		c.webConfigFile = webConfigFileRaw
+	}
 	apiLoginRaw := os.Getenv("TE_API_LOGIN")
 	if len(apiLoginRaw) != 0 {
 		c.apiLogin = apiLoginRaw
@@ -71,5 +307,288 @@ func (c *Config) LoadFromEnv() error {
 	if len(apiEndpointRaw) != 0 {
 		c.apiEndpoint = apiEndpointRaw
 	}
+	if err := durationFromEnv("TE_API_TIMEOUT", &c.apiTimeout); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_API_PAGE_SIZE", &c.apiPageSize); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_API_RETRIES", &c.apiRetries); err != nil {
+		return err
+	}
+	if err := durationFromEnv("TE_API_RETRY_BACKOFF", &c.apiRetryBackoff); err != nil {
+		return err
+	}
+	if err := durationFromEnv("TE_API_RETRY_MAX_BACKOFF", &c.apiRetryMaxBackoff); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_API_BREAKER_THRESHOLD", &c.apiBreakerThreshold); err != nil {
+		return err
+	}
+	if err := durationFromEnv("TE_API_BREAKER_COOLDOWN", &c.apiBreakerCooldown); err != nil {
+		return err
+	}
+	if err := floatFromEnv("TE_API_RATE_LIMIT", &c.apiRateLimit); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_API_RATE_BURST", &c.apiRateBurst); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_API_REQUEST_BUDGET", &c.apiRequestBudget); err != nil {
+		return err
+	}
+	apiCAFileRaw := os.Getenv("TE_API_CA_FILE")
+	if len(apiCAFileRaw) != 0 {
+		c.apiCAFile = apiCAFileRaw
+	}
+	apiCertFileRaw := os.Getenv("TE_API_CERT_FILE")
+	if len(apiCertFileRaw) != 0 {
+		c.apiCertFile = apiCertFileRaw
+	}
+	apiKeyFileRaw := os.Getenv("TE_API_KEY_FILE")
+	if len(apiKeyFileRaw) != 0 {
+		c.apiKeyFile = apiKeyFileRaw
+	}
+	apiServerNameRaw := os.Getenv("TE_API_SERVER_NAME")
+	if len(apiServerNameRaw) != 0 {
+		c.apiServerName = apiServerNameRaw
+	}
+	apiTLSMinVersionRaw := os.Getenv("TE_API_TLS_MIN_VERSION")
+	if len(apiTLSMinVersionRaw) != 0 {
+		c.apiTLSMinVersion = apiTLSMinVersionRaw
+	}
+	if err := boolFromEnv("TE_API_INSECURE_SKIP_VERIFY", &c.apiInsecureSkipVerify); err != nil {
+		return err
+	}
+	apiProxyRaw := os.Getenv("TE_API_PROXY_URL")
+	if len(apiProxyRaw) != 0 {
+		c.apiProxy = apiProxyRaw
+	}
+	apiUserAgentRaw := os.Getenv("TE_API_USER_AGENT")
+	if len(apiUserAgentRaw) != 0 {
+		c.apiUserAgent = apiUserAgentRaw
+	}
+	cacheTTLsRaw := os.Getenv("TE_CACHE_TTLS")
+	if len(cacheTTLsRaw) != 0 {
+		cacheTTLs, err := parseKeyValues(cacheTTLsRaw)
+		if err != nil {
+			return fmt.Errorf("Can't parse TE_CACHE_TTLS: %v", err)
+		}
+		for resource, ttlRaw := range cacheTTLs {
+			if _, found := c.cacheTTLs[resource]; !found {
+				return fmt.Errorf("Can't parse TE_CACHE_TTLS: unknown resource %q", resource)
+			}
+			ttl, err := time.ParseDuration(ttlRaw)
+			if err != nil {
+				return fmt.Errorf("Can't parse TE_CACHE_TTLS: %v", err)
+			}
+			c.cacheTTLs[resource] = ttl
+		}
+	}
+	for name, collector := range c.collectors {
+		key := "TE_COLLECTOR_" + strings.ToUpper(name)
+		if err := boolFromEnv(key, &collector.enabled); err != nil {
+			return err
+		}
+		if err := durationFromEnv(key+"_INTERVAL", &collector.interval); err != nil {
+			return err
+		}
+	}
+	userTeamsRaw := os.Getenv("TE_USER_TEAMS")
+	if len(userTeamsRaw) != 0 {
+		userTeams, err := parseKeyValues(userTeamsRaw)
+		if err != nil {
+			return fmt.Errorf("Can't parse TE_USER_TEAMS: %v", err)
+		}
+		c.userTeams = userTeams
+	}
+	if err := durationFromEnv("TE_FINISHED_BUILDS_WINDOW", &c.finishedBuildsWindow); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_DEPENDENCY_TOP_ROOTS", &c.dependencyTopRoots); err != nil {
+		return err
+	}
+	if err := durationFromEnv("TE_VCS_ROOT_STALE_AFTER", &c.vcsRootStaleAfter); err != nil {
+		return err
+	}
+	if err := intFromEnv("TE_PENDING_CHANGES_MAX_BUILD_TYPES", &c.pendingChangesMaxBuildTypes); err != nil {
+		return err
+	}
+	serverMetricsRaw := os.Getenv("TE_SERVER_METRICS")
+	if len(serverMetricsRaw) != 0 {
+		serverMetrics, err := parseKeyValues(serverMetricsRaw)
+		if err != nil {
+			return fmt.Errorf("Can't parse TE_SERVER_METRICS: %v", err)
+		}
+		for key, name := range serverMetrics {
+			if _, found := serverStorageDescs[key]; !found {
+				return fmt.Errorf("Can't parse TE_SERVER_METRICS: unknown metric %q", key)
+			}
+			c.serverMetrics[key] = name
+		}
+	}
+	usersActiveDaysRaw := os.Getenv("TE_USERS_ACTIVE_DAYS")
+	if len(usersActiveDaysRaw) != 0 {
+		var usersActiveDays []int
+		for _, daysRaw := range splitList(usersActiveDaysRaw) {
+			days, err := strconv.Atoi(daysRaw)
+			if err != nil {
+				return fmt.Errorf("Can't parse TE_USERS_ACTIVE_DAYS: %v", err)
+			}
+			usersActiveDays = append(usersActiveDays, days)
+		}
+		c.usersActiveDays = usersActiveDays
+	}
+	buildStatisticsBuildTypesRaw := os.Getenv("TE_BUILD_STATISTICS_BUILD_TYPES")
+	if len(buildStatisticsBuildTypesRaw) != 0 {
+		c.buildStatisticsBuildTypes = splitList(buildStatisticsBuildTypesRaw)
+	}
+	buildStatisticsKeysRaw := os.Getenv("TE_BUILD_STATISTICS_KEYS")
+	if len(buildStatisticsKeysRaw) != 0 {
+		var buildStatisticsKeys []buildStatisticKey
+		for _, keyRaw := range splitList(buildStatisticsKeysRaw) {
+			key := buildStatisticKey{name: keyRaw}
+			if strings.HasSuffix(keyRaw, ":histogram") {
+				key = buildStatisticKey{name: strings.TrimSuffix(keyRaw, ":histogram"), histogram: true}
+			}
+			buildStatisticsKeys = append(buildStatisticsKeys, key)
+		}
+		c.buildStatisticsKeys = buildStatisticsKeys
+	}
+	buildStatisticsBucketsRaw := os.Getenv("TE_BUILD_STATISTICS_BUCKETS")
+	if len(buildStatisticsBucketsRaw) != 0 {
+		var buildStatisticsBuckets []float64
+		for _, bucketRaw := range splitList(buildStatisticsBucketsRaw) {
+			bucket, err := strconv.ParseFloat(bucketRaw, 64)
+			if err != nil {
+				return fmt.Errorf("Can't parse TE_BUILD_STATISTICS_BUCKETS: %v", err)
+			}
+			buildStatisticsBuckets = append(buildStatisticsBuckets, bucket)
+		}
+		c.buildStatisticsBuckets = buildStatisticsBuckets
+	}
+	pendingChangesBuildTypesRaw := os.Getenv("TE_PENDING_CHANGES_BUILD_TYPES")
+	if len(pendingChangesBuildTypesRaw) != 0 {
+		pendingChangesBuildTypes, err := regexp.Compile(pendingChangesBuildTypesRaw)
+		if err != nil {
+			return fmt.Errorf("Can't parse TE_PENDING_CHANGES_BUILD_TYPES: %v", err)
+		}
+		c.pendingChangesBuildTypes = pendingChangesBuildTypes
+	}
+	return nil
+}
+
+// LoadFromFlags applies collector flags given on the command line, which
+// take precedence over the environment
+func (c *Config) LoadFromFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, r := range collectorRegistry {
+		collector := c.collectors[name]
+		enable, disable := set["collector."+name], set["no-collector."+name]
+		if enable && disable && *r.enableFlag && *r.disableFlag {
+			return fmt.Errorf("Collector %s can't be both enabled and disabled", name)
+		}
+		if enable {
+			collector.enabled = *r.enableFlag
+		}
+		if disable && *r.disableFlag {
+			collector.enabled = false
+		}
+		if set["collector."+name+".interval"] {
+			collector.interval = *r.intervalFlag
+		}
+	}
+	return nil
+}
+
+// userAgent returns the default User-Agent of requests to TeamCity
+func userAgent() string {
+	if len(version.Version) == 0 {
+		return exporterName
+	}
+	return exporterName + "/" + version.Version
+}
+
+// parseKeyValues parses a comma separated list of key=value pairs
+func parseKeyValues(raw string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid key=value pair %q", pair)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// splitList splits a comma separated list skipping empty entries
+func splitList(raw string) []string {
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) != 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func durationFromEnv(key string, v *time.Duration) error {
+	raw := os.Getenv(key)
+	if len(raw) == 0 {
+		return nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("Can't parse %s: %v", key, err)
+	}
+	*v = d
+	return nil
+}
+
+func boolFromEnv(key string, v *bool) error {
+	raw := os.Getenv(key)
+	if len(raw) == 0 {
+		return nil
+	}
+	b, err := strconv.ParseBool(raw)
+	if err != nil {
+		return fmt.Errorf("Can't parse %s: %v", key, err)
+	}
+	*v = b
+	return nil
+}
+
+func floatFromEnv(key string, v *float64) error {
+	raw := os.Getenv(key)
+	if len(raw) == 0 {
+		return nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return fmt.Errorf("Can't parse %s: %v", key, err)
+	}
+	*v = f
+	return nil
+}
+
+func intFromEnv(key string, v *int) error {
+	raw := os.Getenv(key)
+	if len(raw) == 0 {
+		return nil
+	}
+	i, err := strconv.Atoi(raw)
+	if err != nil {
+		return fmt.Errorf("Can't parse %s: %v", key, err)
+	}
+	*v = i
 	return nil
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const buildStateFinished = "finished"
+
+var (
+	dependencyChainLabels = []string{"build_type", "project"}
+
+	buildQueueDependencyBlockedCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_queue_dependency_blocked_count"),
+		"How many builds in queue are waiting for snapshot dependencies",
+		[]string{"project"}, nil,
+	)
+
+	buildQueueDependencyChainBlockedCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_queue_dependency_chain_blocked_count"),
+		"How many queued builds are blocked within the dependency chain of a root build",
+		dependencyChainLabels, nil,
+	)
+
+	buildQueueDependencyChainDepth = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_queue_dependency_chain_depth"),
+		"Length of the longest chain of unfinished snapshot dependencies below a root build",
+		dependencyChainLabels, nil,
+	)
+)
+
+type dependencyChain struct {
+	root    *teamcity.Build
+	blocked int
+	depth   int
+}
+
+// dependencyGraph resolves snapshot dependencies between queued builds
+type dependencyGraph struct {
+	queued map[int]*teamcity.Build
+	depths map[int]int
+}
+
+func newDependencyGraph(bq *teamcity.BuildQueue) *dependencyGraph {
+	g := &dependencyGraph{
+		queued: make(map[int]*teamcity.Build),
+		depths: make(map[int]int),
+	}
+	for i := range bq.Builds {
+		g.queued[bq.Builds[i].ID] = &bq.Builds[i]
+	}
+	return g
+}
+
+// pending returns the snapshot dependencies of a build which are not finished yet
+func (g *dependencyGraph) pending(b *teamcity.Build) []teamcity.Build {
+	var deps []teamcity.Build
+	for _, dep := range b.SnapshotDependencies.Builds {
+		if dep.State != buildStateFinished {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+func (g *dependencyGraph) blocked(b *teamcity.Build) bool {
+	return len(g.pending(b)) != 0
+}
+
+// depth returns the length of the longest chain of unfinished dependencies
+// below the build. Dependencies which are already running end the chain.
+func (g *dependencyGraph) depth(b *teamcity.Build) int {
+	if depth, found := g.depths[b.ID]; found {
+		return depth
+	}
+	// guards against dependency cycles while the depth is being resolved
+	g.depths[b.ID] = 0
+	depth := 0
+	for _, dep := range g.pending(b) {
+		depDepth := 1
+		if queued, found := g.queued[dep.ID]; found {
+			depDepth += g.depth(queued)
+		}
+		if depDepth > depth {
+			depth = depDepth
+		}
+	}
+	g.depths[b.ID] = depth
+	return depth
+}
+
+// countBlocked returns how many blocked queued builds belong to the chain
+// below the build, including the build itself
+func (g *dependencyGraph) countBlocked(b *teamcity.Build, seen map[int]bool) int {
+	if seen[b.ID] {
+		return 0
+	}
+	seen[b.ID] = true
+	count := 0
+	if g.blocked(b) {
+		count++
+	}
+	for _, dep := range g.pending(b) {
+		if queued, found := g.queued[dep.ID]; found {
+			count += g.countBlocked(queued, seen)
+		}
+	}
+	return count
+}
+
+// chains returns blocked queued builds which no other queued build depends on,
+// ordered by the number of blocked builds in their chains
+func (g *dependencyGraph) chains() []dependencyChain {
+	dependents := make(map[int]bool)
+	for _, b := range g.queued {
+		for _, dep := range g.pending(b) {
+			dependents[dep.ID] = true
+		}
+	}
+	var chains []dependencyChain
+	for id, b := range g.queued {
+		if dependents[id] || !g.blocked(b) {
+			continue
+		}
+		chains = append(chains, dependencyChain{
+			root:    b,
+			blocked: g.countBlocked(b, make(map[int]bool)),
+			depth:   g.depth(b),
+		})
+	}
+	sort.Slice(chains, func(i, j int) bool {
+		if chains[i].blocked != chains[j].blocked {
+			return chains[i].blocked > chains[j].blocked
+		}
+		return chains[i].root.ID < chains[j].root.ID
+	})
+	return chains
+}
+
+func (e *Exporter) collectDependencies(ctx context.Context, ch chan<- prometheus.Metric, bq *teamcity.BuildQueue) error {
+	g := newDependencyGraph(bq)
+	skipped := skippedItems{items: "blocked builds and dependency chains"}
+
+	blockedCounts := make(map[string]int)
+	for _, b := range g.queued {
+		if !g.blocked(b) {
+			continue
+		}
+		project, err := e.GetTopProject(ctx, b.BuildType.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		blockedCounts[*project]++
+	}
+	for project, count := range blockedCounts {
+		ch <- prometheus.MustNewConstMetric(
+			buildQueueDependencyBlockedCount, prometheus.GaugeValue, float64(count), project)
+	}
+
+	chains := g.chains()
+	if len(chains) > e.config.dependencyTopRoots {
+		chains = chains[:e.config.dependencyTopRoots]
+	}
+	// several queued builds of the same build type may head a chain
+	roots := make(map[[2]string]dependencyChain)
+	for _, chain := range chains {
+		project, err := e.GetTopProject(ctx, chain.root.BuildType.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		key := [2]string{chain.root.BuildType.ID, *project}
+		root := roots[key]
+		root.blocked += chain.blocked
+		if chain.depth > root.depth {
+			root.depth = chain.depth
+		}
+		roots[key] = root
+	}
+	for key, root := range roots {
+		ch <- prometheus.MustNewConstMetric(
+			buildQueueDependencyChainBlockedCount, prometheus.GaugeValue, float64(root.blocked), key[0], key[1])
+		ch <- prometheus.MustNewConstMetric(
+			buildQueueDependencyChainDepth, prometheus.GaugeValue, float64(root.depth), key[0], key[1])
+	}
+	return skipped.err()
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sirupsen/logrus"
+)
+
+var update = flag.Bool("update", false, "Update golden files of the exporter tests")
+
+// testCollectors are the collectors the fake TeamCity server has fixtures for
+var testCollectors = map[string]bool{
+	"queue":            true,
+	"agents":           true,
+	"finished_builds":  true,
+	"build_statistics": true,
+	"server_storage":   true,
+	"pending_changes":  true,
+	"vcs_roots":        true,
+	"license":          true,
+	"users":            true,
+	"audit":            true,
+}
+
+// nondeterministicMetrics depend on the time of the scrape, so they are left
+// out of golden files
+var nondeterministicMetrics = map[string]bool{
+	"teamcity_collector_duration_seconds":                  true,
+	"teamcity_agent_running_build_elapsed_seconds":         true,
+	"teamcity_agent_pool_busy_seconds_total":               true,
+	"teamcity_agent_last_seen_connected_timestamp_seconds": true,
+	"teamcity_agent_state_seconds_total":                   true,
+}
+
+var (
+	defaultPool = teamcity.Pool{ID: 0, Name: "Default"}
+	windowsPool = teamcity.Pool{ID: 1, Name: "Windows"}
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logrus.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// loggedIn returns the last login of a user who logged in the time ago,
+// so counts of active users don't depend on the time of the test
+func loggedIn(ago time.Duration) string {
+	return time.Now().Add(-ago).Format(teamcity.TimeLayout)
+}
+
+func testFixtures() teamCityFixtures {
+	return teamCityFixtures{
+		server: teamcity.Server{Version: "2017.1.5 (build 47175)", BuildNumber: "47175"},
+		projects: []teamcity.Project{
+			{ID: "Backend", ParentProjectID: "_Root"},
+			{ID: "Backend_Api", ParentProjectID: "Backend"},
+			{ID: "Frontend", ParentProjectID: "_Root"},
+		},
+		agents: []teamcity.Agent{
+			{
+				ID: 1, Name: "linux-1", Pool: defaultPool,
+				EnabledInfo: teamcity.Info{Status: true}, AuthorizedInfo: teamcity.Info{Status: true}, Connected: true,
+				Version: "47175", PluginsVersion: "NA", UpToDate: true,
+				LastActivityTime: "20171018T120000+0000",
+				Properties: teamcity.Properties{
+					"system.feature.linux.version":         "4.4",
+					"teamcity.agent.jvm.os.name":           "Linux",
+					"teamcity.agent.work.dir.freeSpaceMb":  "10240",
+					"teamcity.agent.hardware.cpuCount":     "4",
+					"teamcity.agent.hardware.memorySizeMb": "8192",
+				},
+			},
+			{
+				ID: 2, Name: "windows-1", Pool: windowsPool,
+				EnabledInfo: teamcity.Info{Status: true}, AuthorizedInfo: teamcity.Info{Status: true}, Connected: true,
+				Version: "47000", PluginsVersion: "NA", Upgrading: true,
+				LastActivityTime: "20171018T113000+0000",
+				Properties: teamcity.Properties{
+					"system.feature.windows.version":       "10",
+					"teamcity.agent.jvm.os.name":           "Windows 10",
+					"teamcity.agent.work.dir.freeSpaceMb":  "2048",
+					"teamcity.agent.hardware.cpuCount":     "8",
+					"teamcity.agent.hardware.memorySizeMb": "16384",
+				},
+			},
+			{
+				ID: 3, Name: "linux-2", Pool: defaultPool,
+				EnabledInfo: teamcity.Info{Status: true}, AuthorizedInfo: teamcity.Info{Status: true},
+				Connected: false, DisconnectionComment: "Agent has unregistered",
+				Version: "47175", PluginsVersion: "NA", UpToDate: true,
+				LastActivityTime: "20171018T100000+0000",
+				Properties: teamcity.Properties{
+					"system.feature.linux.version":        "4.4",
+					"teamcity.agent.jvm.os.name":          "Linux",
+					"teamcity.agent.work.dir.freeSpaceMb": "512",
+				},
+			},
+		},
+		queue: []teamcity.Build{
+			{
+				ID: 101, WaitReason: "Build dependencies have not been built yet",
+				BuildType: teamcity.BuildType{ID: "Backend_Api_Test", ProjectID: "Backend_Api"},
+				Triggered: teamcity.Triggered{Type: "vcs"},
+				SnapshotDependencies: teamcity.Builds{Builds: []teamcity.Build{
+					{ID: 100, BuildTypeID: "Backend_Api_Compile", State: "running"},
+				}},
+			},
+			{
+				ID:        102,
+				BuildType: teamcity.BuildType{ID: "Frontend_Deploy", ProjectID: "Frontend"},
+				Triggered: teamcity.Triggered{Type: "user", User: teamcity.User{Username: "alice"}},
+			},
+			{
+				// reasons consisting of separators only are kept as is
+				ID: 103, WaitReason: ":",
+				BuildType: teamcity.BuildType{ID: "Frontend_Deploy", ProjectID: "Frontend"},
+				Triggered: teamcity.Triggered{Type: "schedule"},
+			},
+		},
+		compatible: map[int][]int{
+			101: {1, 3},
+			102: {2},
+			103: {2},
+		},
+		runningBuilds: []teamcity.Build{
+			{
+				ID: 100, BranchName: "master", StartDate: "20171018T115000+0000",
+				BuildType: teamcity.BuildType{ID: "Backend_Api_Compile", ProjectID: "Backend_Api"},
+				Agent:     teamcity.Agent{ID: 1, Name: "linux-1", Pool: defaultPool},
+			},
+		},
+		finishedBuilds: []teamcity.Build{
+			{
+				ID:        90,
+				BuildType: teamcity.BuildType{ID: "Backend_Api_Test", ProjectID: "Backend_Api"},
+				Triggered: teamcity.Triggered{Type: "vcs"},
+			},
+			{
+				ID:        91,
+				BuildType: teamcity.BuildType{ID: "Frontend_Deploy", ProjectID: "Frontend"},
+				Triggered: teamcity.Triggered{Type: "user", User: teamcity.User{Username: "bob"}},
+			},
+		},
+		statistics: map[int]teamcity.Properties{
+			90: {
+				"BuildDurationNetTime": "125000",
+				"TimeSpentInQueue":     "3000",
+				"ArtifactsSize":        "1048576",
+			},
+		},
+		serverMetrics: `# TYPE fake_disk_free_bytes gauge
+fake_disk_free_bytes 1.073741824e+10
+# TYPE fake_data_directory_bytes gauge
+fake_data_directory_bytes 5.36870912e+09
+# TYPE fake_artifacts_bytes gauge
+fake_artifacts_bytes 1.835008e+09
+# TYPE fake_cleanup_start_seconds gauge
+fake_cleanup_start_seconds 1.5083136e+09
+# TYPE fake_cleanup_duration_seconds gauge
+fake_cleanup_duration_seconds 420
+`,
+		buildTypes: []teamcity.BuildType{
+			{ID: "Backend_Api_Compile", ProjectID: "Backend_Api"},
+			{ID: "Backend_Api_Test", ProjectID: "Backend_Api"},
+			{ID: "Frontend_Deploy", ProjectID: "Frontend"},
+		},
+		pendingChanges: map[string][]teamcity.Change{
+			"Backend_Api_Test": {
+				{ID: 503, Date: "20171018T113000+0000"},
+				{ID: 502, Date: "20171018T110000+0000"},
+				{ID: 501, Date: "20171018T103000+0000"},
+			},
+			"Frontend_Deploy": {
+				{ID: 504, Date: "20171018T114500+0000"},
+			},
+		},
+		vcsRootInstances: []teamcity.VcsRootInstance{
+			{
+				// an instance of a parametrized root failing to check for
+				// changes fails the whole root
+				ID: "1", VcsRootID: "Backend_Git", LastVersion: "abc",
+				Status:  teamcity.VcsStatus{Current: teamcity.VcsCheckStatus{Status: "ERROR", Timestamp: "20171018T110000+0000"}},
+				VcsRoot: teamcity.VcsRoot{ID: "Backend_Git", Project: teamcity.Project{ID: "Backend_Api"}},
+			},
+			{
+				ID: "2", VcsRootID: "Backend_Git", LastVersion: "def",
+				Status:  teamcity.VcsStatus{Current: teamcity.VcsCheckStatus{Status: "FINISHED", Timestamp: "20171018T115000+0000"}},
+				VcsRoot: teamcity.VcsRoot{ID: "Backend_Git", Project: teamcity.Project{ID: "Backend_Api"}},
+			},
+			{
+				// roots with commit hooks are never stale
+				ID: "3", VcsRootID: "Frontend_Git", CommitHookMode: true, LastVersion: "123",
+				Status:  teamcity.VcsStatus{Current: teamcity.VcsCheckStatus{Status: "FINISHED", Timestamp: "20171018T100000+0000"}},
+				VcsRoot: teamcity.VcsRoot{ID: "Frontend_Git", Project: teamcity.Project{ID: "Frontend"}},
+			},
+			{
+				ID: "4", VcsRootID: "Frontend_Svn", LastVersion: "42",
+				Status:  teamcity.VcsStatus{Current: teamcity.VcsCheckStatus{Status: "FINISHED", Timestamp: "20171017T100000+0000"}},
+				VcsRoot: teamcity.VcsRoot{ID: "Frontend_Svn", Project: teamcity.Project{ID: "Frontend"}},
+			},
+		},
+		licensingData: teamcity.LicensingData{
+			MaxAgents: 10, AgentsLeft: 7, UnlimitedBuildTypes: true, ServerLicenseType: "enterprise",
+			LicenseKeys: teamcity.LicenseKeys{Count: 3, LicenseKeys: []teamcity.LicenseKey{
+				{Type: "enterprise", Valid: true, Active: true, ExpirationDate: "20181018T000000+0000", MaintenanceEndDate: "20180418T000000+0000"},
+				{Type: "agent", Valid: true, Active: true, MaintenanceEndDate: "20180118T000000+0000"},
+				{Type: "agent", Valid: true, Active: true, Expired: true, MaintenanceEndDate: "20170118T000000+0000"},
+			}},
+		},
+		users: []teamcity.User{
+			{ID: 1, LastLogin: loggedIn(2 * time.Hour)},
+			{ID: 2, Realm: "LDAP", LastLogin: loggedIn(3 * 24 * time.Hour)},
+			{ID: 3, Realm: "LDAP"},
+		},
+		auditEvents: []teamcity.AuditEvent{
+			{ID: 202, Timestamp: "20171018T110000+0000", Action: teamcity.AuditAction{ID: "buildTypeEdited", Name: "build_type_edit"}},
+			{ID: 201, Timestamp: "20171018T100000+0000", Action: teamcity.AuditAction{ID: "projectCreated", Name: "project_create"}},
+		},
+	}
+}
+
+// newTestExporter returns an exporter of the fake TeamCity server running
+// the test collectors on every scrape without retries, requesting collections
+// in small pages, so following nextHref is exercised
+func newTestExporter(t *testing.T, f *fakeTeamCity, password string) *Exporter {
+	config := NewConfig()
+	config.apiLogin = fakeLogin
+	config.apiPassword = password
+	config.apiEndpoint = f.URL + "/"
+	config.apiRetries = 0
+	config.apiRateLimit = 0
+	config.apiPageSize = 2
+	config.userTeams = map[string]string{"alice": "frontend"}
+	config.buildStatisticsBuildTypes = []string{"Backend_Api_Test"}
+	// names of server metrics are made up, they differ between TeamCity
+	// versions and are mapped by users
+	config.serverMetrics = map[string]string{
+		serverMetricFreeSpace:         "fake_disk_free_bytes",
+		serverMetricDataDirectorySize: "fake_data_directory_bytes",
+		serverMetricArtifactsSize:     "fake_artifacts_bytes",
+		serverMetricCleanupTimestamp:  "fake_cleanup_start_seconds",
+		serverMetricCleanupDuration:   "fake_cleanup_duration_seconds",
+	}
+	config.buildStatisticsKeys = []buildStatisticKey{
+		{name: "BuildDurationNetTime", histogram: true},
+		{name: "TimeSpentInQueue"},
+		{name: "ArtifactsSize"},
+	}
+	for name, collector := range config.collectors {
+		collector.enabled = testCollectors[name]
+		collector.interval = 0
+	}
+	if err := config.Load(); err != nil {
+		t.Fatalf("Can't load config: %v", err)
+	}
+	return NewExporter(config)
+}
+
+// scrape collects the exporter returning its metrics in the text exposition
+// format without nondeterministic metrics
+func scrape(t *testing.T, e *Exporter) []byte {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %v", err)
+	}
+	var buf bytes.Buffer
+	for _, family := range families {
+		if nondeterministicMetrics[family.GetName()] {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+			t.Fatalf("Can't write metrics: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func assertGolden(t *testing.T, name string, actual []byte) {
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := ioutil.WriteFile(path, actual, 0644); err != nil {
+			t.Fatalf("Can't update golden file: %v", err)
+		}
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Can't read golden file: %v", err)
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Metrics differ from %s, run go test -update to accept them:\n%s", path, actual)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		setup    func(f *fakeTeamCity)
+	}{
+		{
+			name:     "fixtures",
+			password: fakePassword,
+		},
+		{
+			name:     "unauthorized",
+			password: "wrong",
+		},
+		{
+			name:     "server_error",
+			password: fakePassword,
+			setup: func(f *fakeTeamCity) {
+				f.override("/app/rest/agents", http.StatusInternalServerError, "Internal server error")
+			},
+		},
+		{
+			name:     "malformed_json",
+			password: fakePassword,
+			setup: func(f *fakeTeamCity) {
+				f.override("/app/rest/buildQueue", http.StatusOK, `{"count":1,"build":[{"id":101,`)
+			},
+		},
+		{
+			name:     "missing_properties",
+			password: fakePassword,
+			setup: func(f *fakeTeamCity) {
+				f.override("/app/rest/agents", http.StatusOK, `{"count":3,"agent":[`+
+					`{"id":1,"name":"linux-1","pool":{"id":0,"name":"Default"},"connected":true},`+
+					`{"id":2,"name":"windows-1","pool":{"id":1,"name":"Windows"},"connected":true,"properties":null},`+
+					`{"id":3,"name":"linux-2","pool":{"id":0,"name":"Default"},"connected":true,"properties":{"count":1,"property":[{"value":"4.4"}]}}]}`)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeTeamCity(testFixtures())
+			defer f.Close()
+			if test.setup != nil {
+				test.setup(f)
+			}
+			e := newTestExporter(t, f, test.password)
+			assertGolden(t, test.name, scrape(t, e))
+		})
+	}
+}
+
+// panickingCollector panics on every update
+type panickingCollector struct{}
+
+func (panickingCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	var reasons []string
+	_ = reasons[0]
+	return nil
+}
+
+func TestCollectAllRecoversPanics(t *testing.T) {
+	collectors := map[string]Collector{
+		"panicking": panickingCollector{},
+		"scheduled": newScheduledCollector(panickingCollector{}, time.Minute),
+	}
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collectAll(context.Background(), collectors, ch)
+		close(ch)
+	}()
+	failed := make(map[string]bool)
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatalf("Can't write metric: %v", err)
+		}
+		if m.Desc() == collectorSuccess && metric.GetGauge().GetValue() == 0 {
+			failed[metric.Label[0].GetValue()] = true
+		}
+	}
+	for name := range collectors {
+		if !failed[name] {
+			t.Errorf("Expected collector %s to be reported as failed", name)
+		}
+	}
+}
+
+func TestCollectRetriesServerErrors(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	f.override("/app/rest/server", http.StatusInternalServerError, "Internal server error")
+	e := newTestExporter(t, f, fakePassword)
+	e.config.apiRetries = 2
+	e.config.apiRetryBackoff = time.Millisecond
+	scrape(t, e)
+	if requests := f.requested("/app/rest/server"); requests != 3 {
+		t.Errorf("Expected 3 requests of the server, got %d", requests)
+	}
+}
+
+func TestCollectRequestsServerOnce(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	e := newTestExporter(t, f, fakePassword)
+	scrape(t, e)
+	if requests := f.requested("/app/rest/server"); requests != 1 {
+		t.Errorf("Expected 1 request of the server per scrape, got %d", requests)
+	}
+}
+
+func TestCollectCachesProjects(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	e := newTestExporter(t, f, fakePassword)
+	projects := []string{"Backend", "Backend_Api", "Frontend"}
+	scrape(t, e)
+	requests := make(map[string]int)
+	for _, project := range projects {
+		requests[project] = f.requested("/app/rest/projects/id:" + project)
+		if requests[project] == 0 {
+			t.Errorf("Expected project %s to be requested", project)
+		}
+	}
+	scrape(t, e)
+	for _, project := range projects {
+		if n := f.requested("/app/rest/projects/id:" + project); n != requests[project] {
+			t.Errorf("Expected project %s to be served from the cache, got %d more requests", project, n-requests[project])
+		}
+	}
+}
+
+func TestCollectRevalidatesExpiredResponses(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	e := newTestExporter(t, f, fakePassword)
+	e.config.cacheTTLs["build_types"] = time.Nanosecond
+	first := scrape(t, e)
+	requests := f.requested("/app/rest/buildTypes")
+	second := scrape(t, e)
+	if n := f.requested("/app/rest/buildTypes"); n != 2*requests {
+		t.Errorf("Expected expired pages of build types to be requested again, got %d requests after %d", n, requests)
+	}
+	if n := f.revalidated("/app/rest/buildTypes"); n != requests {
+		t.Errorf("Expected %d pages of build types to be revalidated, got %d", requests, n)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Expected revalidated responses to be served from the cache, metrics differ:\n%s", second)
+	}
+}
+
+func TestAuditCountsEventsSinceWatermark(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	e := newTestExporter(t, f, fakePassword)
+	scrape(t, e)
+	if metrics := string(scrape(t, e)); strings.Contains(metrics, "teamcity_audit_events_total{") {
+		t.Errorf("Expected events recorded before the exporter started not to be counted:\n%s", metrics)
+	}
+	requests := f.requested("/app/rest/audit")
+	edited := teamcity.AuditAction{ID: "buildTypeEdited", Name: "build_type_edit"}
+	f.recordAuditEvents(
+		teamcity.AuditEvent{ID: 205, Action: edited, RelatedEntities: teamcity.RelatedEntities{Entities: []teamcity.RelatedEntity{
+			{Type: "buildType", BuildType: teamcity.BuildType{ID: "Backend_Api_Test", ProjectID: "Backend_Api"}},
+		}}},
+		teamcity.AuditEvent{ID: 204, Action: edited, RelatedEntities: teamcity.RelatedEntities{Entities: []teamcity.RelatedEntity{
+			{Type: "project", Project: teamcity.Project{ID: "Backend"}},
+		}}},
+		teamcity.AuditEvent{ID: 203, Action: teamcity.AuditAction{ID: "userCreated"}},
+	)
+	metrics := string(scrape(t, e))
+	for _, expected := range []string{
+		`teamcity_audit_events_total{action="build_type_edit",project="Backend"} 2`,
+		`teamcity_audit_events_total{action="userCreated",project=""} 1`,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("Expected %s in metrics:\n%s", expected, metrics)
+		}
+	}
+	// the events since the watermark span two pages of two events
+	if n := f.requested("/app/rest/audit") - requests; n != 2 {
+		t.Errorf("Expected 2 pages of audit events to be requested, got %d", n)
+	}
+}
+
+// observedBuilds returns how many builds of the build type the build
+// statistics histogram observed
+func observedBuilds(t *testing.T, e *Exporter, buildTypeID string) uint64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Can't gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "teamcity_build_statistic_value" {
+			continue
+		}
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "build_type" && label.GetValue() == buildTypeID {
+					return m.Histogram.GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestBuildStatisticsObservesEveryBuild(t *testing.T) {
+	f := newFakeTeamCity(testFixtures())
+	defer f.Close()
+	e := newTestExporter(t, f, fakePassword)
+	if observed := observedBuilds(t, e, "Backend_Api_Test"); observed != 1 {
+		t.Fatalf("Expected the latest build to be observed, got %d builds", observed)
+	}
+
+	// builds finished since are served newest first
+	f.mu.Lock()
+	var builds []teamcity.Build
+	for id := 1000 + buildStatisticsLimit + 49; id >= 1000; id-- {
+		builds = append(builds, teamcity.Build{ID: id, BuildType: teamcity.BuildType{ID: "Backend_Api_Test", ProjectID: "Backend_Api"}})
+		f.fixtures.statistics[id] = teamcity.Properties{"BuildDurationNetTime": "60000"}
+	}
+	f.fixtures.finishedBuilds = append(builds, f.fixtures.finishedBuilds...)
+	f.mu.Unlock()
+
+	if observed := observedBuilds(t, e, "Backend_Api_Test"); observed != 1+buildStatisticsLimit {
+		t.Errorf("Expected %d builds to be observed, got %d", 1+buildStatisticsLimit, observed)
+	}
+	if observed := observedBuilds(t, e, "Backend_Api_Test"); observed != 1+buildStatisticsLimit+50 {
+		t.Errorf("Expected %d builds to be observed, got %d", 1+buildStatisticsLimit+50, observed)
+	}
+}
+
+// newHungExporter returns an exporter of a TeamCity server which never
+// responds, with retries and API timeouts outlasting the test
+func newHungExporter(t *testing.T) (*Exporter, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	config := NewConfig()
+	config.apiLogin = fakeLogin
+	config.apiPassword = fakePassword
+	config.apiEndpoint = server.URL + "/"
+	config.apiTimeout = time.Minute
+	config.apiBreakerThreshold = 0
+	if err := config.Load(); err != nil {
+		t.Fatalf("Can't load config: %v", err)
+	}
+	return NewExporter(config), server.Close
+}
+
+func TestCollectStopsAtScrapeTimeout(t *testing.T) {
+	e, closeServer := newHungExporter(t)
+	defer closeServer()
+	e.config.scrapeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	metrics := scrape(t, e)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the scrape to stop at its timeout, it took %s", elapsed)
+	}
+	if !bytes.Contains(metrics, []byte("teamcity_up 0")) {
+		t.Errorf("Expected TeamCity to be reported down, got:\n%s", metrics)
+	}
+}
+
+func TestMetricsHandlerUsesPrometheusScrapeTimeout(t *testing.T) {
+	e, closeServer := newHungExporter(t)
+	defer closeServer()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.6")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	e.MetricsHandler().ServeHTTP(w, req)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the scrape to stop at the timeout sent by Prometheus, it took %s", elapsed)
+	}
+	if !strings.Contains(w.Body.String(), "teamcity_up 0") {
+		t.Errorf("Expected TeamCity to be reported down, got:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+)
+
+const (
+	fakeLogin    = "exporter"
+	fakePassword = "secret"
+)
+
+var (
+	// compatibleLocatorRegexp matches the locator of agents compatible with
+	// a queued build, e.g. compatible:(build:(id:1))
+	compatibleLocatorRegexp = regexp.MustCompile(`compatible:\(build:\(id:(\d+)\)\)`)
+
+	// buildTypeLocatorRegexp matches the locator of builds of a build type,
+	// e.g. buildType:(id:Foo)
+	buildTypeLocatorRegexp = regexp.MustCompile(`buildType:\(id:([^)]+)\)`)
+
+	countLocatorRegexp      = regexp.MustCompile(`count:(\d+)`)
+	startLocatorRegexp      = regexp.MustCompile(`,?start:(\d+)`)
+	sinceBuildLocatorRegexp = regexp.MustCompile(`sinceBuild:\(id:(\d+)\)`)
+
+	// buildStatisticsPathRegexp matches the path of statistics of a build
+	buildStatisticsPathRegexp = regexp.MustCompile(`^/app/rest/builds/id:(\d+)/statistics$`)
+)
+
+// teamCityFixtures are the resources served by the fake TeamCity server
+type teamCityFixtures struct {
+	server teamcity.Server
+	queue  []teamcity.Build
+	agents []teamcity.Agent
+	// compatible maps IDs of queued builds to IDs of agents they can run on
+	compatible     map[int][]int
+	projects       []teamcity.Project
+	runningBuilds  []teamcity.Build
+	finishedBuilds []teamcity.Build
+	// statistics maps IDs of finished builds to their statistics
+	statistics map[int]teamcity.Properties
+	// serverMetrics are the server metrics in the Prometheus text format
+	serverMetrics string
+	buildTypes    []teamcity.BuildType
+	// pendingChanges maps IDs of build types to changes not built yet
+	pendingChanges   map[string][]teamcity.Change
+	vcsRootInstances []teamcity.VcsRootInstance
+	licensingData    teamcity.LicensingData
+	users            []teamcity.User
+	// auditEvents are the audit events, newest first
+	auditEvents []teamcity.AuditEvent
+}
+
+// fakeProperty and fakeProperties encode properties the way TeamCity does,
+// as a list of name and value pairs sorted by name
+type fakeProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type fakeProperties struct {
+	Count    int            `json:"count"`
+	Property []fakeProperty `json:"property"`
+}
+
+func newFakeProperties(properties teamcity.Properties) fakeProperties {
+	props := make([]fakeProperty, 0, len(properties))
+	for name, value := range properties {
+		props = append(props, fakeProperty{Name: name, Value: value})
+	}
+	sort.Slice(props, func(i, j int) bool { return props[i].Name < props[j].Name })
+	return fakeProperties{Count: len(props), Property: props}
+}
+
+// fakeAgent encodes an agent with its properties the way TeamCity does
+type fakeAgent struct {
+	teamcity.Agent
+	Properties fakeProperties `json:"properties"`
+}
+
+type fakeAgents struct {
+	Count    int         `json:"count"`
+	NextHref string      `json:"nextHref,omitempty"`
+	Agents   []fakeAgent `json:"agent"`
+}
+
+func newFakeAgents(agents []teamcity.Agent, next string) fakeAgents {
+	fake := fakeAgents{Count: len(agents), NextHref: next}
+	for _, agent := range agents {
+		fake.Agents = append(fake.Agents, fakeAgent{Agent: agent, Properties: newFakeProperties(agent.Properties)})
+	}
+	return fake
+}
+
+// fakeResponse is served instead of the fixtures for a path
+type fakeResponse struct {
+	status int
+	body   string
+}
+
+// fakeTeamCity is an in-process TeamCity REST API serving fixtures with
+// basic authentication. Collections are paged with nextHref and responses
+// carry an ETag, so unchanged ones are revalidated with 304 Not Modified.
+// Responses of paths may be overridden to inject failures.
+type fakeTeamCity struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	fixtures    teamCityFixtures
+	overrides   map[string]fakeResponse
+	requests    map[string]int
+	notModified map[string]int
+}
+
+func newFakeTeamCity(fixtures teamCityFixtures) *fakeTeamCity {
+	f := &fakeTeamCity{
+		fixtures:    fixtures,
+		overrides:   make(map[string]fakeResponse),
+		requests:    make(map[string]int),
+		notModified: make(map[string]int),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// override serves the response for the path, e.g. /app/rest/agents,
+// instead of the fixtures
+func (f *fakeTeamCity) override(path string, status int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[path] = fakeResponse{status: status, body: body}
+}
+
+// requested returns how many times the path was requested
+func (f *fakeTeamCity) requested(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+// revalidated returns how many times the path was answered with 304 Not
+// Modified
+func (f *fakeTeamCity) revalidated(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.notModified[path]
+}
+
+// recordAuditEvents adds the events, newest first, to the audit log
+func (f *fakeTeamCity) recordAuditEvents(events ...teamcity.AuditEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fixtures.auditEvents = append(events, f.fixtures.auditEvents...)
+}
+
+func (f *fakeTeamCity) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[r.URL.Path]++
+	if login, password, ok := r.BasicAuth(); !ok || login != fakeLogin || password != fakePassword {
+		http.Error(w, "Incorrect username or password", http.StatusUnauthorized)
+		return
+	}
+	if resp, found := f.overrides[r.URL.Path]; found {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		w.Write([]byte(resp.body))
+		return
+	}
+	locator := r.URL.Query().Get("locator")
+	switch path := r.URL.Path; {
+	case path == "/app/rest/server":
+		f.write(w, r, f.fixtures.server)
+	case path == "/app/rest/server/licensingData":
+		f.write(w, r, f.fixtures.licensingData)
+	case path == "/app/rest/buildQueue":
+		start, end, next := page(r, len(f.fixtures.queue))
+		f.write(w, r, teamcity.BuildQueue{Count: end - start, NextHref: next, Builds: f.fixtures.queue[start:end]})
+	case path == "/app/rest/agents":
+		agents := f.fixtures.agents
+		if m := compatibleLocatorRegexp.FindStringSubmatch(locator); m != nil {
+			id, _ := strconv.Atoi(m[1])
+			agents = f.compatibleAgents(id)
+		}
+		start, end, next := page(r, len(agents))
+		f.write(w, r, newFakeAgents(agents[start:end], next))
+	case path == "/app/rest/builds":
+		builds := f.fixtures.finishedBuilds
+		if strings.Contains(locator, "running:true") {
+			builds = f.fixtures.runningBuilds
+		} else if m := buildTypeLocatorRegexp.FindStringSubmatch(locator); m != nil {
+			builds = f.finishedBuildsOfType(m[1], locator)
+		}
+		start, end, next := page(r, len(builds))
+		f.write(w, r, teamcity.Builds{Count: end - start, NextHref: next, Builds: builds[start:end]})
+	case buildStatisticsPathRegexp.MatchString(path):
+		id, _ := strconv.Atoi(buildStatisticsPathRegexp.FindStringSubmatch(path)[1])
+		statistics, found := f.fixtures.statistics[id]
+		if !found {
+			http.Error(w, "No build found by locator 'id:"+strconv.Itoa(id)+"'", http.StatusNotFound)
+			return
+		}
+		f.write(w, r, newFakeProperties(statistics))
+	case path == "/app/rest/buildTypes":
+		start, end, next := page(r, len(f.fixtures.buildTypes))
+		f.write(w, r, teamcity.BuildTypes{Count: end - start, NextHref: next, BuildTypes: f.fixtures.buildTypes[start:end]})
+	case path == "/app/rest/changes":
+		var changes []teamcity.Change
+		if m := buildTypeLocatorRegexp.FindStringSubmatch(locator); m != nil && strings.Contains(locator, "pending:true") {
+			changes = f.fixtures.pendingChanges[m[1]]
+		}
+		start, end, next := page(r, len(changes))
+		f.write(w, r, teamcity.Changes{Count: end - start, NextHref: next, Changes: changes[start:end]})
+	case path == "/app/rest/vcs-root-instances":
+		instances := f.fixtures.vcsRootInstances
+		start, end, next := page(r, len(instances))
+		f.write(w, r, teamcity.VcsRootInstances{Count: end - start, NextHref: next, Instances: instances[start:end]})
+	case path == "/app/rest/users":
+		f.write(w, r, teamcity.Users{Count: len(f.fixtures.users), Users: f.fixtures.users})
+	case path == "/app/rest/audit":
+		events := f.fixtures.auditEvents
+		start, end, next := page(r, len(events))
+		f.write(w, r, teamcity.AuditEvents{Count: end - start, NextHref: next, Events: events[start:end]})
+	case path == "/app/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(f.fixtures.serverMetrics))
+	case strings.HasPrefix(path, "/app/rest/projects/id:"):
+		id := strings.TrimPrefix(path, "/app/rest/projects/id:")
+		for _, project := range f.fixtures.projects {
+			if project.ID == id {
+				f.write(w, r, project)
+				return
+			}
+		}
+		http.Error(w, "No project found by locator 'id:"+id+"'", http.StatusNotFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeTeamCity) compatibleAgents(buildID int) []teamcity.Agent {
+	var agents []teamcity.Agent
+	for _, id := range f.fixtures.compatible[buildID] {
+		for _, agent := range f.fixtures.agents {
+			if agent.ID == id {
+				agents = append(agents, agent)
+			}
+		}
+	}
+	return agents
+}
+
+// finishedBuildsOfType returns finished builds of the build type, newest
+// first, newer than sinceBuild of the locator
+func (f *fakeTeamCity) finishedBuildsOfType(buildTypeID, locator string) []teamcity.Build {
+	sinceID := 0
+	if m := sinceBuildLocatorRegexp.FindStringSubmatch(locator); m != nil {
+		sinceID, _ = strconv.Atoi(m[1])
+	}
+	var builds []teamcity.Build
+	for _, build := range f.fixtures.finishedBuilds {
+		if build.BuildType.ID == buildTypeID && build.ID > sinceID {
+			builds = append(builds, build)
+		}
+	}
+	return builds
+}
+
+// page returns the range of n items requested by start and count of the
+// locator, and nextHref of the next page if there is one, the way TeamCity
+// pages collections
+func page(r *http.Request, n int) (int, int, string) {
+	locator := r.URL.Query().Get("locator")
+	start, end := 0, n
+	if m := startLocatorRegexp.FindStringSubmatch(locator); m != nil {
+		start, _ = strconv.Atoi(m[1])
+	}
+	if m := countLocatorRegexp.FindStringSubmatch(locator); m != nil {
+		count, _ := strconv.Atoi(m[1])
+		end = start + count
+	}
+	if start > n {
+		start = n
+	}
+	if end >= n {
+		return start, n, ""
+	}
+	query := url.Values{}
+	query.Set("locator", startLocatorRegexp.ReplaceAllString(locator, "")+",start:"+strconv.Itoa(end))
+	if fields := r.URL.Query().Get("fields"); len(fields) != 0 {
+		query.Set("fields", fields)
+	}
+	return start, end, r.URL.Path + "?" + query.Encode()
+}
+
+// write encodes v tagged with an ETag of the encoding, answering requests
+// which already have it with 304 Not Modified
+func (f *fakeTeamCity) write(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(body))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		f.notModified[r.URL.Path]++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
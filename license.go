@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	licenseAgentsMax = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "agents_max"),
+		"How many agents are allowed by the licenses",
+		nil, nil,
+	)
+
+	licenseAgentsUsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "agents_used"),
+		"How many agent licenses are used",
+		nil, nil,
+	)
+
+	licenseAgentsUnlimited = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "agents_unlimited"),
+		"Whether the licenses allow an unlimited number of agents",
+		nil, nil,
+	)
+
+	licenseBuildTypesMax = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "build_types_max"),
+		"How many build configurations are allowed by the licenses",
+		nil, nil,
+	)
+
+	licenseBuildTypesUsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "build_types_used"),
+		"How many build configurations are used",
+		nil, nil,
+	)
+
+	licenseBuildTypesUnlimited = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "build_types_unlimited"),
+		"Whether the licenses allow an unlimited number of build configurations",
+		nil, nil,
+	)
+
+	licenseExceeded = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "exceeded"),
+		"Whether the license usage is exceeded",
+		nil, nil,
+	)
+
+	licenseKeyExpiration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "key_expiration_timestamp_seconds"),
+		"When the earliest active license key of the type expires",
+		[]string{"type"}, nil,
+	)
+
+	licenseKeyMaintenanceEnd = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "license", "key_maintenance_end_timestamp_seconds"),
+		"When the maintenance of the earliest active license key of the type ends",
+		[]string{"type"}, nil,
+	)
+)
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// earliestDate keeps the earliest of the dates by type
+func earliestDate(dates map[string]float64, keyType string, date string) {
+	if len(date) == 0 {
+		return
+	}
+	t, err := teamcity.ParseTime(date)
+	if err != nil {
+		logrus.Errorf("Can't parse license key date: %s", err)
+		return
+	}
+	ts := float64(t.Unix())
+	if current, found := dates[keyType]; !found || ts < current {
+		dates[keyType] = ts
+	}
+}
+
+func init() {
+	registerCollector("license", true, 0, priorityNormal, newLicenseCollector)
+}
+
+type licenseCollector struct {
+	e *Exporter
+}
+
+func newLicenseCollector(e *Exporter) Collector {
+	return &licenseCollector{e: e}
+}
+
+func (c *licenseCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	data, err := c.e.client.GetLicensingData(ctx)
+	if err != nil {
+		return err
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		licenseAgentsUnlimited, prometheus.GaugeValue, boolToFloat(data.UnlimitedAgents))
+	if !data.UnlimitedAgents {
+		ch <- prometheus.MustNewConstMetric(
+			licenseAgentsMax, prometheus.GaugeValue, float64(data.MaxAgents))
+		ch <- prometheus.MustNewConstMetric(
+			licenseAgentsUsed, prometheus.GaugeValue, float64(data.MaxAgents-data.AgentsLeft))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		licenseBuildTypesUnlimited, prometheus.GaugeValue, boolToFloat(data.UnlimitedBuildTypes))
+	if !data.UnlimitedBuildTypes {
+		ch <- prometheus.MustNewConstMetric(
+			licenseBuildTypesMax, prometheus.GaugeValue, float64(data.MaxBuildTypes))
+		ch <- prometheus.MustNewConstMetric(
+			licenseBuildTypesUsed, prometheus.GaugeValue, float64(data.MaxBuildTypes-data.BuildTypesLeft))
+	}
+	ch <- prometheus.MustNewConstMetric(
+		licenseExceeded, prometheus.GaugeValue, boolToFloat(data.LicenseUseExceeded))
+
+	expirations := make(map[string]float64)
+	maintenanceEnds := make(map[string]float64)
+	for _, key := range data.LicenseKeys.LicenseKeys {
+		if !key.Active || key.Expired {
+			continue
+		}
+		earliestDate(expirations, key.Type, key.ExpirationDate)
+		earliestDate(maintenanceEnds, key.Type, key.MaintenanceEndDate)
+	}
+	for keyType, ts := range expirations {
+		ch <- prometheus.MustNewConstMetric(
+			licenseKeyExpiration, prometheus.GaugeValue, ts, keyType)
+	}
+	for keyType, ts := range maintenanceEnds {
+		ch <- prometheus.MustNewConstMetric(
+			licenseKeyMaintenanceEnd, prometheus.GaugeValue, ts, keyType)
+	}
+	return nil
+}
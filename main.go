@@ -8,15 +8,13 @@ import (
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	namespace     = "teamcity"
-	exporterName  = "teamcity_queue_exporter"
-	reasonDefault = "There are no compatible or available agents for this build"
+	namespace    = "teamcity"
+	exporterName = "teamcity_queue_exporter"
 )
 
 var (
@@ -27,22 +25,6 @@ var (
 		"Was the last query of TeamCity successful",
 		nil, nil,
 	)
-
-	buildLabels = []string{"reason", "project", "buildId", "pool", "winOk", "linOk", "macOk"}
-
-	agentLabels = []string{"name", "pool", "os", "enabled", "authorized", "connected", "project", "busy"}
-
-	buildQueueWaitCount = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "build_queue_wait_count"),
-		"How many builds in queue waiting in queue",
-		buildLabels, nil,
-	)
-
-	agentInfoCount = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "agent_type_count"),
-		"How many agents by metadata",
-		agentLabels, nil,
-	)
 )
 
 func init() {
@@ -73,20 +55,29 @@ func main() {
 		os.Exit(1)
 	}
 
+	if config.apiInsecureSkipVerify {
+		logrus.Warn("TLS certificate verification of TeamCity is disabled")
+	}
+
 	exporter := NewExporter(config)
-	prometheus.MustRegister(exporter)
 
-	http.Handle(config.metricPath, promhttp.Handler())
+	http.Handle(config.metricPath, exporter.MetricsHandler())
+	collectors := ""
+	for _, name := range exporter.EnabledCollectors() {
+		collectors += "<li>" + name + "</li>"
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>TeamCity Queue Exporter v` + version.Version + `</title></head>
 			<body>
 			<h1>TeamCity Queue Exporter v` + version.Version + `</h1>
 			<p><a href='` + config.metricPath + `'>Metrics</a></p>
+			<h2>Enabled collectors</h2>
+			<ul>` + collectors + `</ul>
 			</body>
 			</html>
 		`))
 	})
-	logrus.Fatal(http.ListenAndServe(config.listenAddress, nil))
+	logrus.Fatal(listenAndServe(config, http.DefaultServeMux))
 
 }
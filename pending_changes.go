@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	pendingChangesLabels = []string{"build_type", "project"}
+
+	buildTypePendingChangesCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build_type", "pending_changes_count"),
+		"How many changes are not built yet by the build type",
+		pendingChangesLabels, nil,
+	)
+
+	buildTypeOldestPendingChangeTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "build_type", "oldest_pending_change_timestamp_seconds"),
+		"When the oldest change not built yet by the build type was made",
+		pendingChangesLabels, nil,
+	)
+)
+
+// pendingChangesBuildTypes returns the build types to check for pending
+// changes, limited by the configured filter and maximum count
+func (e *Exporter) pendingChangesBuildTypes(buildTypes *teamcity.BuildTypes) []teamcity.BuildType {
+	var selected []teamcity.BuildType
+	for _, bt := range buildTypes.BuildTypes {
+		if e.config.pendingChangesBuildTypes != nil && !e.config.pendingChangesBuildTypes.MatchString(bt.ID) {
+			continue
+		}
+		selected = append(selected, bt)
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].ID < selected[j].ID })
+	if len(selected) > e.config.pendingChangesMaxBuildTypes {
+		logrus.Warnf("Checking pending changes of %d out of %d build types, see TE_PENDING_CHANGES_MAX_BUILD_TYPES",
+			e.config.pendingChangesMaxBuildTypes, len(selected))
+		selected = selected[:e.config.pendingChangesMaxBuildTypes]
+	}
+	return selected
+}
+
+func init() {
+	registerCollector("pending_changes", true, 5*time.Minute, priorityLow, newPendingChangesCollector)
+}
+
+type pendingChangesCollector struct {
+	e *Exporter
+}
+
+func newPendingChangesCollector(e *Exporter) Collector {
+	return &pendingChangesCollector{e: e}
+}
+
+func (c *pendingChangesCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	buildTypes, err := e.client.GetBuildTypes(ctx)
+	if err != nil {
+		return err
+	}
+	skipped := skippedItems{items: "build types"}
+	for _, bt := range e.pendingChangesBuildTypes(buildTypes) {
+		project, err := e.GetTopProject(ctx, bt.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		changes, err := e.client.GetPendingChanges(ctx, bt.ID)
+		if err != nil {
+			logrus.Errorf("Can't get pending changes of %s: %s", bt.ID, err)
+			skipped.skip(err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			buildTypePendingChangesCount, prometheus.GaugeValue, float64(len(changes.Changes)), bt.ID, *project)
+
+		var oldest time.Time
+		for _, change := range changes.Changes {
+			date, err := teamcity.ParseTime(change.Date)
+			if err != nil {
+				logrus.Errorf("Can't parse date of change %d: %s", change.ID, err)
+				continue
+			}
+			if oldest.IsZero() || date.Before(oldest) {
+				oldest = date
+			}
+		}
+		if !oldest.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				buildTypeOldestPendingChangeTimestamp, prometheus.GaugeValue, float64(oldest.Unix()), bt.ID, *project)
+		}
+	}
+	return skipped.err()
+}
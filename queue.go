@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const reasonDefault = "There are no compatible or available agents for this build"
+
+var (
+	buildLabels = []string{"reason", "project", "buildId", "pool", "winOk", "linOk", "macOk"}
+
+	buildQueueWaitCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_queue_wait_count"),
+		"How many builds in queue waiting in queue",
+		buildLabels, nil,
+	)
+)
+
+func init() {
+	registerCollector("queue", true, 0, priorityHigh, newQueueCollector)
+}
+
+type queueCollector struct {
+	e *Exporter
+}
+
+func newQueueCollector(e *Exporter) Collector {
+	return &queueCollector{e: e}
+}
+
+func (c *queueCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	bq, err := e.client.GetBuildQueue(ctx)
+	if err != nil {
+		return err
+	}
+	metrics := map[string]map[string]map[int]map[string]map[bool]map[bool]map[bool]int{}
+	metrics = make(map[string]map[string]map[int]map[string]map[bool]map[bool]map[bool]int)
+	triggerCounts := make(map[triggerKey]int)
+	skipped := skippedItems{items: "queued builds"}
+	//for each build in queue
+	for _, b := range bq.Builds {
+		logrus.Debugf("b: %+v", b)
+		//get reason
+		reason := b.WaitReason
+		if len(reason) == 0 {
+			logrus.Infof("Build has no reason: %+v", b)
+			reason = reasonDefault
+		}
+		reason = firstField(reason, ':') //strip off anything after a ":"
+		reason = firstField(reason, ',') //strip off anything after a ","
+		for len(strings.FieldsFunc(reason, func(c rune) bool { return c == '"' })) >= 2 {
+			var tmp = strings.FieldsFunc(reason, func(c rune) bool { return c == '"' })
+			reason = tmp[0] + strings.Join(tmp[2:], "\"")
+		}
+		tmpproj, err := e.GetTopProject(ctx, b.BuildType.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		project := *tmpproj
+		triggerCounts[e.newTriggerKey(b.Triggered, project)]++
+		//get list of compatible agents
+		ca, err := e.client.GetCompatibleAgents(ctx, b.ID)
+		if err != nil {
+			logrus.Errorf("Can't get compatible agents: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		for _, agent := range ca.Agents {
+			poolname := agent.Pool.Name
+			if len(poolname) == 0 {
+				poolname = "Default"
+			}
+			buildID := int(b.ID)
+			//add metric to metric map for id, reason, pool, project, and allowed OS
+			if _, found := metrics[reason]; !found {
+				metrics[reason] = make(map[string]map[int]map[string]map[bool]map[bool]map[bool]int)
+			}
+			if _, found := metrics[reason][project]; !found {
+				metrics[reason][project] = make(map[int]map[string]map[bool]map[bool]map[bool]int)
+			}
+			if _, found := metrics[reason][project][b.ID]; !found {
+				metrics[reason][project][buildID] = make(map[string]map[bool]map[bool]map[bool]int)
+			}
+			if _, found := metrics[reason][project][buildID][poolname]; !found {
+				metrics[reason][project][buildID][poolname] = make(map[bool]map[bool]map[bool]int)
+			}
+			var winOk = false
+			var linOk = false
+			var macOk = false
+			for _, a := range ca.Agents {
+				winOk = winOk || strings.Contains(a.Properties["teamcity.agent.jvm.os.name"], "Windows")
+				linOk = linOk || strings.Contains(a.Properties["teamcity.agent.jvm.os.name"], "Linux")
+				macOk = macOk || strings.Contains(a.Properties["teamcity.agent.jvm.os.name"], "Mac")
+			}
+			metrics[reason][project][buildID][poolname][winOk] = make(map[bool]map[bool]int)
+			metrics[reason][project][buildID][poolname][winOk][linOk] = make(map[bool]int)
+			metrics[reason][project][buildID][poolname][winOk][linOk][macOk] = 1
+		}
+	}
+
+	logrus.Debugf("metrics: %+v", metrics)
+
+	//for each entry in metric map
+	for reason, projmap := range metrics {
+		for project, idmap := range projmap {
+			for id, poolmap := range idmap {
+				for poolname, winmap := range poolmap {
+					for win, linmap := range winmap {
+						for lin, macmap := range linmap {
+							for mac, count := range macmap {
+								//publish metric
+								ch <- prometheus.MustNewConstMetric(
+									buildQueueWaitCount, prometheus.GaugeValue, float64(count), reason, project, strconv.Itoa(id), poolname,
+									strconv.FormatBool(win), strconv.FormatBool(lin), strconv.FormatBool(mac))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	collectTriggerCounts(ch, buildQueueTriggerCount, triggerCounts)
+	dependenciesErr := e.collectDependencies(ctx, ch, bq)
+	if err := skipped.err(); err != nil {
+		return err
+	}
+	return dependenciesErr
+}
+
+// firstField returns the first field of s separated by sep, or s itself if
+// it consists of separators only
+func firstField(s string, sep rune) string {
+	fields := strings.FieldsFunc(s, func(c rune) bool { return c == sep })
+	if len(fields) == 0 {
+		return s
+	}
+	return fields[0]
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// requestPriority decides which requests are deferred first once the
+// request budget of a refresh runs low
+type requestPriority int
+
+const (
+	priorityLow requestPriority = iota
+	priorityNormal
+	priorityHigh
+)
+
+// priorityShares are the parts of the request budget requests of the
+// priority may use, so low priority collectors degrade first
+var priorityShares = map[requestPriority]float64{
+	priorityLow:    0.75,
+	priorityNormal: 0.9,
+	priorityHigh:   1.0,
+}
+
+type priorityKey struct{}
+
+// withPriority returns the context of requests of the priority
+func withPriority(ctx context.Context, priority requestPriority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// priorityFromContext returns the priority of requests made with the
+// context, high unless set with withPriority
+func priorityFromContext(ctx context.Context) requestPriority {
+	if priority, ok := ctx.Value(priorityKey{}).(requestPriority); ok {
+		return priority
+	}
+	return priorityHigh
+}
+
+func (p requestPriority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityNormal:
+		return "normal"
+	case priorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// tokenBucket limits the rate of requests to TeamCity allowing bursts of up
+// to burst requests, a rate of 0 disables it
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available or the context is done. Tokens are
+// reserved in advance, so concurrent callers queue up instead of all waking
+// at once; the token of a canceled wait is given back.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b.rate == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// requestBudget limits how many requests are made per refresh of the
+// exporter, a limit of 0 disables it
+type requestBudget struct {
+	mu    sync.Mutex
+	limit int
+	used  int
+}
+
+func newRequestBudget(limit int) *requestBudget {
+	return &requestBudget{limit: limit}
+}
+
+func (b *requestBudget) reset() {
+	b.mu.Lock()
+	b.used = 0
+	b.mu.Unlock()
+}
+
+// take reports whether a request of the priority fits into the budget
+func (b *requestBudget) take(priority requestPriority) bool {
+	if b.limit == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if float64(b.used) >= float64(b.limit)*priorityShares[priority] {
+		return false
+	}
+	b.used++
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	b := newTokenBucket(1, 1)
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatalf("Expected the burst to be available, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := b.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected waiting past the deadline to fail, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the wait to stop at the deadline, waited %s", elapsed)
+	}
+	b.mu.Lock()
+	tokens := b.tokens
+	b.mu.Unlock()
+	// the reserved token is given back, so the bucket is merely empty
+	if tokens < -0.1 || tokens > 0.1 {
+		t.Errorf("Expected the token of the canceled wait to be given back, got %f tokens", tokens)
+	}
+
+	if err := newTokenBucket(0, 0).wait(ctx); err != nil {
+		t.Errorf("Expected a rate of 0 to disable limiting, got %v", err)
+	}
+}
+
+func TestRequestBudgetTake(t *testing.T) {
+	b := newRequestBudget(20)
+	taken := make(map[requestPriority]int)
+	for _, priority := range []requestPriority{priorityLow, priorityNormal, priorityHigh} {
+		for b.take(priority) {
+			taken[priority]++
+		}
+	}
+	// low priority requests may use 75% of the budget, normal ones 90%
+	expected := map[requestPriority]int{priorityLow: 15, priorityNormal: 3, priorityHigh: 2}
+	for priority, count := range expected {
+		if taken[priority] != count {
+			t.Errorf("Expected %d %s priority requests to fit, got %d", count, priority, taken[priority])
+		}
+	}
+
+	b.reset()
+	if !b.take(priorityLow) {
+		t.Errorf("Expected the budget to be available after reset")
+	}
+	if !newRequestBudget(0).take(priorityLow) {
+		t.Errorf("Expected a limit of 0 to disable the budget")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// States of the circuit breaker as exported by the state metric
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var (
+	breakerStates = []string{breakerClosed, breakerOpen, breakerHalfOpen}
+
+	errBreakerOpen = errors.New("TeamCity API circuit breaker is open")
+)
+
+// retryable reports whether the attempt failed in a way worth retrying:
+// timeouts, rate limiting and server errors
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) && netErr.Timeout()
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// breakerFailure reports whether the attempt counts as a failure of the
+// server for the circuit breaker: any transport error, including refused
+// connections, DNS and TLS errors, and server errors
+func breakerFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+// retryAfter returns the delay requested by the Retry-After header of 429
+// and 503 responses, which is either in seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	raw := resp.Header.Get("Retry-After")
+	if len(raw) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(raw); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// backoff returns the delay before the retry following the attempt, growing
+// exponentially up to max with half of it jittered
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// circuitBreaker stops requests to TeamCity after the threshold of
+// consecutive failures, letting a single request through once the cooldown
+// has passed to probe whether the server recovered
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	b.setState(breakerClosed)
+	return b
+}
+
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	for _, s := range breakerStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		apiBreakerState.WithLabelValues(s).Set(value)
+	}
+}
+
+// allow returns errBreakerOpen if the request must not be made
+func (b *circuitBreaker) allow() error {
+	if b.threshold == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return errBreakerOpen
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return errBreakerOpen
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// abort releases a request allowed by the breaker which wasn't made
+func (b *circuitBreaker) abort() {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// done records the outcome of a request allowed by the breaker
+func (b *circuitBreaker) done(failed bool) {
+	if b.threshold == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scheduledMetrics caches the metrics of an expensive collection and
+// refreshes them only once the interval has passed since the last refresh
+type scheduledMetrics struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	lastRefresh time.Time
+	metrics     []prometheus.Metric
+}
+
+func newScheduledMetrics(interval time.Duration) *scheduledMetrics {
+	return &scheduledMetrics{interval: interval}
+}
+
+// collect sends the cached metrics to ch, refreshing them first if they are
+// stale. Metrics of the previous refresh are kept if refresh fails.
+func (s *scheduledMetrics) collect(ch chan<- prometheus.Metric, refresh func(ch chan<- prometheus.Metric) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if time.Since(s.lastRefresh) >= s.interval {
+		var metrics []prometheus.Metric
+		metricsCh := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for m := range metricsCh {
+				metrics = append(metrics, m)
+			}
+			close(done)
+		}()
+		func() {
+			// a panicking refresh must not leave the receiver behind
+			defer close(metricsCh)
+			err = refresh(metricsCh)
+		}()
+		<-done
+		if err == nil {
+			s.metrics = metrics
+			s.lastRefresh = time.Now()
+		}
+	}
+
+	for _, m := range s.metrics {
+		ch <- m
+	}
+	return err
+}
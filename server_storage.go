@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+// Keys of the TE_SERVER_METRICS mapping
+const (
+	serverMetricFreeSpace         = "free_space"
+	serverMetricDataDirectorySize = "data_directory_size"
+	serverMetricArtifactsSize     = "artifacts_size"
+	serverMetricCleanupTimestamp  = "cleanup_timestamp"
+	serverMetricCleanupDuration   = "cleanup_duration"
+)
+
+var (
+	serverDiskFreeBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", "disk_free_bytes"),
+		"Free space on the disk of the TeamCity data directory",
+		nil, nil,
+	)
+
+	serverDataDirectorySize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", "data_directory_size_bytes"),
+		"Size of the TeamCity data directory",
+		nil, nil,
+	)
+
+	serverArtifactsSize = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", "artifacts_size_bytes"),
+		"Size of build artifacts stored by the TeamCity server",
+		nil, nil,
+	)
+
+	serverCleanupLastRunTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", "cleanup_last_run_timestamp_seconds"),
+		"When the last cleanup of the TeamCity server started",
+		nil, nil,
+	)
+
+	serverCleanupLastRunDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "server", "cleanup_last_run_duration_seconds"),
+		"How long the last cleanup of the TeamCity server took",
+		nil, nil,
+	)
+
+	// serverStorageDescs are the storage metrics by key of TE_SERVER_METRICS
+	serverStorageDescs = map[string]*prometheus.Desc{
+		serverMetricFreeSpace:         serverDiskFreeBytes,
+		serverMetricDataDirectorySize: serverDataDirectorySize,
+		serverMetricArtifactsSize:     serverArtifactsSize,
+		serverMetricCleanupTimestamp:  serverCleanupLastRunTimestamp,
+		serverMetricCleanupDuration:   serverCleanupLastRunDuration,
+	}
+)
+
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	}
+	return 0
+}
+
+func init() {
+	registerCollector("server_storage", false, 0, priorityNormal, newServerStorageCollector)
+}
+
+type serverStorageCollector struct {
+	e *Exporter
+}
+
+func newServerStorageCollector(e *Exporter) Collector {
+	return &serverStorageCollector{e: e}
+}
+
+func (c *serverStorageCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	families, err := e.client.GetServerMetrics(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(e.config.serverMetrics))
+	for key := range e.config.serverMetrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// the first sample of the family is used, metrics of the server are
+	// expected to have a single one
+	var missing []string
+	for _, key := range keys {
+		name := e.config.serverMetrics[key]
+		family, found := families[name]
+		if !found || len(family.Metric) == 0 {
+			missing = append(missing, name)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			serverStorageDescs[key], prometheus.GaugeValue, metricValue(family.Metric[0]))
+	}
+	if len(missing) == len(keys) {
+		return fmt.Errorf("None of the server metrics %s are published by TeamCity at %s", strings.Join(missing, ", "), teamcity.ServerMetricsRoute)
+	}
+	if len(missing) != 0 {
+		logrus.Warnf("Server metrics %s are not published by TeamCity, check TE_SERVER_METRICS", strings.Join(missing, ", "))
+	}
+	return nil
+}
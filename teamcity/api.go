@@ -0,0 +1,280 @@
+package teamcity
+
+import (
+	"context"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Fields of the resources requested by the client
+var (
+	buildTypeFields      = NewFields("id", "href", "name", "projectName", "projectId")
+	triggeredFields      = NewFields("type", "date").Nested("user", NewFields("id", "username", "name"))
+	propertiesFields     = NewFields("property")
+	vcsCheckStatusFields = NewFields("status", "requestorType", "timestamp")
+
+	licenseKeyFields    = NewFields("type", "valid", "active", "expired", "expirationDate", "maintenanceEndDate")
+	licensingDataFields = NewFields("maxAgents", "unlimitedAgents", "agentsLeft", "maxBuildTypes", "unlimitedBuildTypes",
+		"buildTypesLeft", "licenseUseExceeded", "serverLicenseType").Nested("licenseKeys", NewFields("count").Nested("licenseKey", licenseKeyFields))
+
+	snapshotDependenciesFields = NewFields().Nested("build", NewFields("id", "buildTypeId", "state"))
+	queuedBuildFields          = NewFields("id", "waitReason", "href").Nested("buildType", buildTypeFields).Nested("triggered", triggeredFields).Nested("snapshot-dependencies", snapshotDependenciesFields)
+	buildQueueFields           = NewFields("count", "href", "nextHref").Nested("build", queuedBuildFields)
+
+	compatibleAgentFields  = NewFields("id", "href", "pool", "name").Nested("properties", propertiesFields)
+	compatibleAgentsFields = NewFields("count", "nextHref").Nested("agent", compatibleAgentFields)
+	agentFields            = NewFields("id", "href", "enabledInfo", "authorizedInfo", "connected", "disconnectionComment", "lastActivityTime",
+		"version", "pluginsVersion", "uptodate", "upgrading", "pool", "name").Nested("properties", propertiesFields)
+	agentsFields = NewFields("count", "nextHref").Nested("agent", agentFields)
+
+	runningBuildFields   = NewFields("id", "branchName", "startDate", "buildType").Nested("agent", NewFields("id", "href", "name", "pool"))
+	runningBuildsFields  = NewFields("count", "href", "nextHref").Nested("build", runningBuildFields)
+	finishedBuildFields  = NewFields("id").Nested("buildType", NewFields("id", "projectId")).Nested("triggered", triggeredFields)
+	finishedBuildsFields = NewFields("count", "href", "nextHref").Nested("build", finishedBuildFields)
+	buildsOfTypeFields   = NewFields("count", "href", "nextHref").Nested("build", NewFields("id", "buildTypeId"))
+
+	vcsStatusFields        = NewFields().Nested("current", vcsCheckStatusFields).Nested("previous", vcsCheckStatusFields)
+	vcsRootFields          = NewFields("id", "name", "href").Nested("project", NewFields("id"))
+	vcsRootInstanceFields  = NewFields("id", "name", "href", "vcs-root-id", "commitHookMode", "lastVersion").Nested("status", vcsStatusFields).Nested("vcs-root", vcsRootFields)
+	vcsRootInstancesFields = NewFields("count", "href", "nextHref").Nested("vcs-root-instance", vcsRootInstanceFields)
+
+	buildTypesFields     = NewFields("count", "href", "nextHref").Nested("buildType", buildTypeFields)
+	pendingChangesFields = NewFields("count", "href", "nextHref").Nested("change", NewFields("id", "href", "date"))
+	usersFields          = NewFields("count").Nested("user", NewFields("id", "realm", "lastLogin"))
+
+	relatedEntityFields = NewFields("type").Nested("project", NewFields("id")).Nested("buildType", NewFields("id", "projectId"))
+	auditEventFields    = NewFields("id", "timestamp").Nested("action", NewFields("id", "name")).Nested("relatedEntities", NewFields().Nested("entity", relatedEntityFields))
+	auditEventsFields   = NewFields("count", "href", "nextHref").Nested("auditEvent", auditEventFields)
+)
+
+func (c *Client) GetServer(ctx context.Context) (*Server, error) {
+	server := &Server{}
+	if err := c.Get(ctx, "app/rest/server", server); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+func (c *Client) GetLicensingData(ctx context.Context) (*LicensingData, error) {
+	licensingData := &LicensingData{}
+	if err := c.Get(ctx, route("app/rest/server/licensingData", NewLocator(), licensingDataFields), licensingData); err != nil {
+		return nil, err
+	}
+	return licensingData, nil
+}
+
+// GetBuildQueue returns all queued builds with their triggers and snapshot
+// dependencies
+func (c *Client) GetBuildQueue(ctx context.Context) (*BuildQueue, error) {
+	queue := &BuildQueue{}
+	it := c.Pages("app/rest/buildQueue", NewLocator(), buildQueueFields)
+	var page BuildQueue
+	for it.Next(ctx, &page) {
+		queue.Builds = append(queue.Builds, page.Builds...)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	queue.Count = len(queue.Builds)
+	return queue, nil
+}
+
+func (c *Client) GetQueuedBuild(ctx context.Context, id int) (*Build, error) {
+	build := &Build{}
+	if err := c.Get(ctx, "app/rest/buildQueue/"+NewLocator().Add("id", id).String(), build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+// GetCompatibleAgents returns agents the queued build can run on
+func (c *Client) GetCompatibleAgents(ctx context.Context, buildID int) (*Agents, error) {
+	locator := NewLocator().Add("compatible", NewLocator().Add("build", NewLocator().Add("id", buildID)))
+	return c.getAgents(ctx, locator, compatibleAgentsFields)
+}
+
+func (c *Client) GetAgent(ctx context.Context, id int) (*Agent, error) {
+	agent := &Agent{}
+	if err := c.Get(ctx, "app/rest/agents/"+NewLocator().Add("id", id).String(), agent); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// GetAgents returns all agents including unauthorized ones
+func (c *Client) GetAgents(ctx context.Context) (*Agents, error) {
+	locator := NewLocator().Add("authorized", "any").Add("defaultFilter", false)
+	return c.getAgents(ctx, locator, agentsFields)
+}
+
+func (c *Client) getAgents(ctx context.Context, locator Locator, fields Fields) (*Agents, error) {
+	agents := &Agents{}
+	it := c.Pages("app/rest/agents", locator, fields)
+	var page Agents
+	for it.Next(ctx, &page) {
+		agents.Agents = append(agents.Agents, page.Agents...)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	agents.Count = len(agents.Agents)
+	return agents, nil
+}
+
+func (c *Client) GetRunningBuilds(ctx context.Context) (*Builds, error) {
+	return c.getBuilds(ctx, NewLocator().Add("running", true), runningBuildsFields, 0)
+}
+
+// GetFinishedBuilds returns up to limit builds finished since the time
+func (c *Client) GetFinishedBuilds(ctx context.Context, since time.Time, limit int) (*Builds, error) {
+	locator := NewLocator().Add("state", "finished").Add("sinceDate", since)
+	return c.getBuilds(ctx, locator, finishedBuildsFields, limit)
+}
+
+// getBuilds requests all pages of the builds, stopping at limit builds
+// unless limit is 0
+func (c *Client) getBuilds(ctx context.Context, locator Locator, fields Fields, limit int) (*Builds, error) {
+	builds := &Builds{}
+	it := c.Pages("app/rest/builds", locator, fields)
+	var page Builds
+	for it.Next(ctx, &page) {
+		builds.Builds = append(builds.Builds, page.Builds...)
+		if limit != 0 && len(builds.Builds) >= limit {
+			builds.Builds = builds.Builds[:limit]
+			break
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	builds.Count = len(builds.Builds)
+	return builds, nil
+}
+
+// GetFinishedBuildsOfType returns finished builds of the build type newer
+// than the build with sinceID, newest first, following pages up to limit
+// builds unless limit is 0. Only the latest build is returned if sinceID is
+// zero.
+func (c *Client) GetFinishedBuildsOfType(ctx context.Context, buildTypeID string, sinceID int, limit int) (*Builds, error) {
+	locator := NewLocator().Add("buildType", NewLocator().Add("id", buildTypeID)).Add("state", "finished")
+	if sinceID == 0 {
+		return c.getBuilds(ctx, locator.Add("count", 1), buildsOfTypeFields, 1)
+	}
+	return c.getBuilds(ctx, locator.Add("sinceBuild", NewLocator().Add("id", sinceID)), buildsOfTypeFields, limit)
+}
+
+func (c *Client) GetBuildStatistics(ctx context.Context, id int) (*Properties, error) {
+	statistics := &Properties{}
+	if err := c.Get(ctx, "app/rest/builds/"+NewLocator().Add("id", id).String()+"/statistics", statistics); err != nil {
+		return nil, err
+	}
+	return statistics, nil
+}
+
+func (c *Client) GetVcsRootInstances(ctx context.Context) (*VcsRootInstances, error) {
+	instances := &VcsRootInstances{}
+	it := c.Pages("app/rest/vcs-root-instances", NewLocator(), vcsRootInstancesFields)
+	var page VcsRootInstances
+	for it.Next(ctx, &page) {
+		instances.Instances = append(instances.Instances, page.Instances...)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	instances.Count = len(instances.Instances)
+	return instances, nil
+}
+
+func (c *Client) GetBuildTypes(ctx context.Context) (*BuildTypes, error) {
+	buildTypes := &BuildTypes{}
+	it := c.Pages("app/rest/buildTypes", NewLocator(), buildTypesFields)
+	var page BuildTypes
+	for it.Next(ctx, &page) {
+		buildTypes.BuildTypes = append(buildTypes.BuildTypes, page.BuildTypes...)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	buildTypes.Count = len(buildTypes.BuildTypes)
+	return buildTypes, nil
+}
+
+// GetPendingChanges returns changes not built yet by the build type
+func (c *Client) GetPendingChanges(ctx context.Context, buildTypeID string) (*Changes, error) {
+	changes := &Changes{}
+	locator := NewLocator().Add("pending", true).Add("buildType", NewLocator().Add("id", buildTypeID))
+	it := c.Pages("app/rest/changes", locator, pendingChangesFields)
+	var page Changes
+	for it.Next(ctx, &page) {
+		changes.Changes = append(changes.Changes, page.Changes...)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	changes.Count = len(changes.Changes)
+	return changes, nil
+}
+
+// ServerMetricsRoute is where the TeamCity server publishes its metrics in
+// the Prometheus text format
+const ServerMetricsRoute = "app/metrics"
+
+// GetServerMetrics returns the metrics the TeamCity server exposes in the
+// Prometheus text format
+func (c *Client) GetServerMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	resp, err := c.Do(ctx, ServerMetricsRoute, "text/plain")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, c.decodeError(ServerMetricsRoute, err)
+	}
+	return families, nil
+}
+
+func (c *Client) GetUsers(ctx context.Context) (*Users, error) {
+	users := &Users{}
+	if err := c.Get(ctx, route("app/rest/users", NewLocator(), usersFields), users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetAuditEvents returns up to limit audit events newer than the event with
+// the ID sinceID, newest first. Pages are requested until an event which is
+// not newer is reached, so the events recorded since are fetched only.
+func (c *Client) GetAuditEvents(ctx context.Context, sinceID, limit int) (*AuditEvents, error) {
+	events := &AuditEvents{}
+	it := c.Pages("app/rest/audit", NewLocator(), auditEventsFields)
+	var page AuditEvents
+pages:
+	for it.Next(ctx, &page) {
+		for _, event := range page.Events {
+			if event.ID <= sinceID {
+				break pages
+			}
+			events.Events = append(events.Events, event)
+			if len(events.Events) >= limit {
+				break pages
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	events.Count = len(events.Events)
+	return events, nil
+}
+
+func (c *Client) GetProject(ctx context.Context, id string) (*Project, error) {
+	project := &Project{}
+	if err := c.Get(ctx, "app/rest/projects/"+NewLocator().Add("id", id).String(), project); err != nil {
+		return nil, err
+	}
+	return project, nil
+}
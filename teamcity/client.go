@@ -0,0 +1,106 @@
+// Package teamcity is a client of the TeamCity REST API
+package teamcity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// DefaultPageSize is the count of items per page of paginated collections
+const DefaultPageSize = 100
+
+// StatusError is returned when TeamCity responds with a status other than
+// 200 OK
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Error requesting url: %s (%s)", e.URL, e.Status)
+}
+
+// Client requests the TeamCity REST API with basic authentication
+type Client struct {
+	baseURL  *url.URL
+	username string
+	password string
+
+	// HTTPClient makes the requests, http.DefaultClient by default
+	HTTPClient *http.Client
+	// UserAgent of the requests, the one of net/http if empty
+	UserAgent string
+	// PageSize is the count of items per page of paginated collections,
+	// 0 leaves the page size to TeamCity
+	PageSize int
+	// OnDecodeError is called with every response that can't be decoded
+	OnDecodeError func(err *DecodeError)
+}
+
+// NewClient returns a client of the TeamCity server at baseURL, e.g.
+// https://teamcity.example.com/
+func NewClient(baseURL *url.URL, username, password string) *Client {
+	return &Client{
+		baseURL:    baseURL,
+		username:   username,
+		password:   password,
+		HTTPClient: http.DefaultClient,
+		PageSize:   DefaultPageSize,
+	}
+}
+
+// Do requests the route relative to the base URL accepting the content
+// type. The caller must close the body of the returned response.
+func (c *Client) Do(ctx context.Context, route string, accept string) (*http.Response, error) {
+	r, err := url.Parse(route)
+	if err != nil {
+		return nil, err
+	}
+	u := c.baseURL.ResolveReference(r)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if len(c.UserAgent) != 0 {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	req.SetBasicAuth(c.username, c.password)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{URL: u.String(), StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// Get decodes the JSON response of the route into v. The whole response is
+// held in memory while it's decoded, so collections should be requested in
+// pages of limited size.
+func (c *Client) Get(ctx context.Context, route string, v interface{}) error {
+	resp, err := c.Do(ctx, route, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return c.decodeError(route, err)
+	}
+	return nil
+}
+
+func (c *Client) decodeError(route string, err error) error {
+	decodeErr := newDecodeError(route, err)
+	if c.OnDecodeError != nil {
+		c.OnDecodeError(decodeErr)
+	}
+	return decodeErr
+}
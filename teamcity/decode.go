@@ -0,0 +1,182 @@
+package teamcity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// DecodeError is returned when a response of the TeamCity API can't be
+// decoded, Path locates the offending field if known
+type DecodeError struct {
+	Endpoint string
+	Path     string
+	Err      error
+}
+
+func (e *DecodeError) Error() string {
+	if len(e.Path) == 0 {
+		return fmt.Sprintf("Can't decode response of %s: %v", e.Endpoint, e.Err)
+	}
+	return fmt.Sprintf("Can't decode %s of response of %s: %v", e.Path, e.Endpoint, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// fieldError locates an error of a custom unmarshaler within its value
+type fieldError struct {
+	path string
+	err  error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s: %v", e.path, e.err)
+}
+
+// itemError locates the error of an item of a collection by the path of the
+// item, e.g. agent[3], prefixing the path of the field within the item
+func itemError(path string, err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var fieldErr *fieldError
+	switch {
+	case errors.As(err, &fieldErr):
+		return &fieldError{path: path + "." + fieldErr.path, err: fieldErr.err}
+	case errors.As(err, &typeErr) && len(typeErr.Field) != 0:
+		return &fieldError{path: path + "." + typeErr.Field, err: err}
+	}
+	return &fieldError{path: path, err: err}
+}
+
+// decodeItems decodes raw items of a collection one by one into the slice
+// pointed to by v, so errors are located by the index of the item
+func decodeItems(name string, items []json.RawMessage, v interface{}) error {
+	if items == nil {
+		return nil
+	}
+	slice := reflect.ValueOf(v).Elem()
+	slice.Set(reflect.MakeSlice(slice.Type(), len(items), len(items)))
+	for i, item := range items {
+		if err := json.Unmarshal(item, slice.Index(i).Addr().Interface()); err != nil {
+			return itemError(fmt.Sprintf("%s[%d]", name, i), err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes agents one by one, locating errors by the agent
+func (a *Agents) UnmarshalJSON(b []byte) error {
+	type agents Agents
+	var s struct {
+		agents
+		Agents []json.RawMessage `json:"agent"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*a = Agents(s.agents)
+	return decodeItems("agent", s.Agents, &a.Agents)
+}
+
+// UnmarshalJSON decodes builds one by one, locating errors by the build
+func (b *Builds) UnmarshalJSON(data []byte) error {
+	type builds Builds
+	var s struct {
+		builds
+		Builds []json.RawMessage `json:"build"`
+	}
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*b = Builds(s.builds)
+	return decodeItems("build", s.Builds, &b.Builds)
+}
+
+// UnmarshalJSON decodes queued builds one by one, locating errors by the
+// build
+func (q *BuildQueue) UnmarshalJSON(data []byte) error {
+	return (*Builds)(q).UnmarshalJSON(data)
+}
+
+// UnmarshalJSON decodes changes one by one, locating errors by the change
+func (c *Changes) UnmarshalJSON(b []byte) error {
+	type changes Changes
+	var s struct {
+		changes
+		Changes []json.RawMessage `json:"change"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*c = Changes(s.changes)
+	return decodeItems("change", s.Changes, &c.Changes)
+}
+
+func newDecodeError(route string, err error) *DecodeError {
+	decodeErr := &DecodeError{Endpoint: Endpoint(route), Err: err}
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var fieldErr *fieldError
+	switch {
+	case errors.As(err, &fieldErr):
+		decodeErr.Path = fieldErr.path
+		decodeErr.Err = fieldErr.err
+	case errors.As(err, &typeErr):
+		decodeErr.Path = typeErr.Field
+	case errors.As(err, &syntaxErr):
+		decodeErr.Path = fmt.Sprintf("offset %d", syntaxErr.Offset)
+	}
+	return decodeErr
+}
+
+// propertyValue returns the value of a property as a string, whatever its
+// JSON type is. Absent and null values are empty.
+func propertyValue(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// UnmarshalJSON decodes properties defensively: absent or null properties
+// are empty, values of any type are kept as strings and properties without
+// a name are skipped
+func (p *Properties) UnmarshalJSON(b []byte) error {
+	*p = make(Properties)
+	if string(b) == "null" {
+		return nil
+	}
+	var s struct {
+		Property json.RawMessage `json:"property"`
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return &fieldError{path: "properties", err: err}
+	}
+	if len(s.Property) == 0 || string(s.Property) == "null" {
+		return nil
+	}
+	var props []json.RawMessage
+	if err := json.Unmarshal(s.Property, &props); err != nil {
+		return &fieldError{path: "properties.property", err: err}
+	}
+	for i, prop := range props {
+		var proptmp struct {
+			Name  *string         `json:"name"`
+			Value json.RawMessage `json:"value"`
+		}
+		if err := json.Unmarshal(prop, &proptmp); err != nil {
+			return &fieldError{path: fmt.Sprintf("properties.property[%d]", i), err: err}
+		}
+		if proptmp.Name == nil || len(*proptmp.Name) == 0 {
+			continue
+		}
+		(*p)[*proptmp.Name] = propertyValue(proptmp.Value)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package teamcity
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeErrorPath(t *testing.T) {
+	tests := []struct {
+		route    string
+		body     string
+		v        interface{}
+		expected string
+	}{
+		{"app/rest/agents", `{"count":2,"agent":[{"id":1},{"id":"2"}]}`, &Agents{}, "agent[1].id"},
+		{"app/rest/agents", `{"count":1,"agent":[{"id":1,"properties":{"property":[{"name":"a"},"b"]}}]}`, &Agents{}, "agent[0].properties.property[1]"},
+		{"app/rest/builds", `{"count":1,"build":[{"id":1,"agent":{"id":"1"}}]}`, &Builds{}, "build[0].agent.id"},
+		{"app/rest/buildQueue", `{"count":"1","build":[]}`, &BuildQueue{}, "count"},
+		{"app/rest/changes", `{"count":2,"change":[{"id":1},{"id":2,"date":5}]}`, &Changes{}, "change[1].date"},
+	}
+	for _, test := range tests {
+		err := json.Unmarshal([]byte(test.body), test.v)
+		if err == nil {
+			t.Errorf("Expected decoding %s to fail", test.body)
+			continue
+		}
+		if actual := newDecodeError(test.route, err).Path; actual != test.expected {
+			t.Errorf("Expected path %q decoding %s, got %q", test.expected, test.body, actual)
+		}
+	}
+}
+
+func TestDecodeCollection(t *testing.T) {
+	var agents Agents
+	body := `{"count":2,"nextHref":"/app/rest/agents?locator=start:2","agent":[{"id":1,"name":"linux-1"},{"id":2,"properties":null}]}`
+	if err := json.Unmarshal([]byte(body), &agents); err != nil {
+		t.Fatalf("Can't decode agents: %v", err)
+	}
+	if agents.Count != 2 || agents.NextHref != "/app/rest/agents?locator=start:2" {
+		t.Errorf("Expected count and nextHref to be decoded, got %d and %q", agents.Count, agents.NextHref)
+	}
+	if len(agents.Agents) != 2 || agents.Agents[0].Name != "linux-1" || agents.Agents[1].ID != 2 {
+		t.Errorf("Expected agents to be decoded, got %+v", agents.Agents)
+	}
+}
@@ -0,0 +1,120 @@
+package teamcity
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// locatorSegmentRegexp matches path segments holding a locator, e.g. id:123
+var locatorSegmentRegexp = regexp.MustCompile(`^([A-Za-z]+):.+$`)
+
+type dimension struct {
+	name  string
+	value string
+}
+
+// Locator selects TeamCity resources by dimensions, e.g.
+// NewLocator().Add("buildType", NewLocator().Add("id", "Foo")).Add("running", true)
+// is buildType:(id:Foo),running:true
+type Locator struct {
+	dimensions []dimension
+}
+
+func NewLocator() Locator {
+	return Locator{}
+}
+
+// Add returns the locator with the dimension added. Nested locators are
+// enclosed in parentheses, times are formatted with TimeLayout and other
+// values are escaped for the query.
+func (l Locator) Add(name string, value interface{}) Locator {
+	var raw string
+	switch v := value.(type) {
+	case Locator:
+		raw = "(" + v.String() + ")"
+	case time.Time:
+		raw = url.QueryEscape(v.Format(TimeLayout))
+	default:
+		raw = url.QueryEscape(fmt.Sprint(v))
+	}
+	dimensions := make([]dimension, len(l.dimensions), len(l.dimensions)+1)
+	copy(dimensions, l.dimensions)
+	return Locator{dimensions: append(dimensions, dimension{name: name, value: raw})}
+}
+
+// Has reports whether the locator has the dimension
+func (l Locator) Has(name string) bool {
+	for _, d := range l.dimensions {
+		if d.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Locator) String() string {
+	dimensions := make([]string, len(l.dimensions))
+	for i, d := range l.dimensions {
+		dimensions[i] = d.name + ":" + d.value
+	}
+	return strings.Join(dimensions, ",")
+}
+
+// Fields selects attributes of returned resources, e.g.
+// NewFields("count", "href").Nested("build", NewFields("id", "state"))
+// is count,href,build(id,state)
+type Fields struct {
+	fields []string
+}
+
+func NewFields(names ...string) Fields {
+	return Fields{}.Add(names...)
+}
+
+// Add returns the fields with the attributes added
+func (f Fields) Add(names ...string) Fields {
+	fields := make([]string, len(f.fields), len(f.fields)+len(names))
+	copy(fields, f.fields)
+	return Fields{fields: append(fields, names...)}
+}
+
+// Nested returns the fields with the attribute selecting nested fields added
+func (f Fields) Nested(name string, nested Fields) Fields {
+	return f.Add(name + "(" + nested.String() + ")")
+}
+
+func (f Fields) String() string {
+	return strings.Join(f.fields, ",")
+}
+
+// route returns the route of the path with the locator and fields
+func route(path string, locator Locator, fields Fields) string {
+	var params []string
+	if len(locator.dimensions) != 0 {
+		params = append(params, "locator="+locator.String())
+	}
+	if len(fields.fields) != 0 {
+		params = append(params, "fields="+fields.String())
+	}
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// Endpoint returns the route without the query and with locators replaced
+// by placeholders, e.g. app/rest/builds/id:{id}/statistics, suitable as a
+// metric label
+func Endpoint(route string) string {
+	if u, err := url.Parse(route); err == nil {
+		route = u.Path
+	}
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = locatorSegmentRegexp.ReplaceAllString(segment, "$1:{$1}")
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,71 @@
+package teamcity
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocator(t *testing.T) {
+	since := time.Date(2017, 10, 18, 12, 0, 0, 0, time.FixedZone("", 3*60*60))
+	tests := []struct {
+		locator  Locator
+		expected string
+	}{
+		{NewLocator(), ""},
+		{NewLocator().Add("running", true), "running:true"},
+		{NewLocator().Add("buildType", NewLocator().Add("id", "Foo")).Add("count", 10), "buildType:(id:Foo),count:10"},
+		{NewLocator().Add("sinceDate", since), "sinceDate:20171018T120000%2B0300"},
+		{NewLocator().Add("id", "Foo Bar"), "id:Foo+Bar"},
+	}
+	for _, test := range tests {
+		if actual := test.locator.String(); actual != test.expected {
+			t.Errorf("Expected locator %q, got %q", test.expected, actual)
+		}
+	}
+}
+
+func TestLocatorAddKeepsOriginal(t *testing.T) {
+	base := NewLocator().Add("state", "finished")
+	base.Add("count", 1)
+	if base.Has("count") {
+		t.Errorf("Expected Add to leave the original locator unchanged, got %q", base)
+	}
+}
+
+func TestFields(t *testing.T) {
+	fields := NewFields("count", "href").Nested("build", NewFields("id").Nested("agent", NewFields("name")))
+	if expected, actual := "count,href,build(id,agent(name))", fields.String(); actual != expected {
+		t.Errorf("Expected fields %q, got %q", expected, actual)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		locator  Locator
+		fields   Fields
+		expected string
+	}{
+		{NewLocator(), NewFields(), "app/rest/builds"},
+		{NewLocator().Add("running", true), NewFields(), "app/rest/builds?locator=running:true"},
+		{NewLocator().Add("running", true), NewFields("count"), "app/rest/builds?locator=running:true&fields=count"},
+	}
+	for _, test := range tests {
+		if actual := route("app/rest/builds", test.locator, test.fields); actual != test.expected {
+			t.Errorf("Expected route %q, got %q", test.expected, actual)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tests := map[string]string{
+		"app/rest/builds?locator=running:true":              "app/rest/builds",
+		"app/rest/builds/id:123/statistics":                 "app/rest/builds/id:{id}/statistics",
+		"/app/rest/projects/id:Foo_Bar":                     "app/rest/projects/id:{id}",
+		"app/rest/agents?locator=compatible:(build:(id:1))": "app/rest/agents",
+	}
+	for route, expected := range tests {
+		if actual := Endpoint(route); actual != expected {
+			t.Errorf("Expected endpoint of %s to be %q, got %q", route, expected, actual)
+		}
+	}
+}
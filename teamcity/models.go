@@ -0,0 +1,220 @@
+package teamcity
+
+import "time"
+
+// TimeLayout is the date format used by the TeamCity REST API
+const TimeLayout = "20060102T150405-0700"
+
+// ParseTime parses a date returned by the TeamCity REST API
+func ParseTime(value string) (time.Time, error) {
+	return time.Parse(TimeLayout, value)
+}
+
+type Server struct {
+	Version     string `json:"version"`
+	BuildNumber string `json:"buildNumber"`
+	StartTime   string `json:"startTime"`
+}
+
+type LicenseKey struct {
+	Type               string `json:"type"`
+	Valid              bool   `json:"valid"`
+	Active             bool   `json:"active"`
+	Expired            bool   `json:"expired"`
+	ExpirationDate     string `json:"expirationDate"`
+	MaintenanceEndDate string `json:"maintenanceEndDate"`
+}
+
+type LicenseKeys struct {
+	Count       int          `json:"count"`
+	LicenseKeys []LicenseKey `json:"licenseKey"`
+}
+
+type LicensingData struct {
+	MaxAgents           int         `json:"maxAgents"`
+	UnlimitedAgents     bool        `json:"unlimitedAgents"`
+	AgentsLeft          int         `json:"agentsLeft"`
+	MaxBuildTypes       int         `json:"maxBuildTypes"`
+	UnlimitedBuildTypes bool        `json:"unlimitedBuildTypes"`
+	BuildTypesLeft      int         `json:"buildTypesLeft"`
+	LicenseUseExceeded  bool        `json:"licenseUseExceeded"`
+	ServerLicenseType   string      `json:"serverLicenseType"`
+	LicenseKeys         LicenseKeys `json:"licenseKeys"`
+}
+
+type Builds struct {
+	Count    int     `json:"count"`
+	Href     string  `json:"href"`
+	NextHref string  `json:"nextHref"`
+	Builds   []Build `json:"build"`
+}
+
+type BuildQueue Builds
+
+type BuildType struct {
+	ID          string `json:"id"`
+	Href        string `json:"href"`
+	Name        string `json:"name"`
+	ProjectName string `json:"projectName"`
+	ProjectID   string `json:"projectId"`
+}
+
+type BuildTypes struct {
+	Count      int         `json:"count"`
+	Href       string      `json:"href"`
+	NextHref   string      `json:"nextHref"`
+	BuildTypes []BuildType `json:"buildType"`
+}
+
+type Change struct {
+	ID   int    `json:"id"`
+	Href string `json:"href"`
+	Date string `json:"date"`
+}
+
+type Changes struct {
+	Count    int      `json:"count"`
+	Href     string   `json:"href"`
+	NextHref string   `json:"nextHref"`
+	Changes  []Change `json:"change"`
+}
+
+type Build struct {
+	ID                   int       `json:"id"`
+	BuildTypeID          string    `json:"buildTypeId"`
+	State                string    `json:"state"`
+	WaitReason           string    `json:"waitReason"`
+	BranchName           string    `json:"branchName"`
+	StartDate            string    `json:"startDate"`
+	Href                 string    `json:"href"`
+	BuildType            BuildType `json:"buildType"`
+	Agent                Agent     `json:"agent"`
+	Triggered            Triggered `json:"triggered"`
+	SnapshotDependencies Builds    `json:"snapshot-dependencies"`
+}
+
+type Triggered struct {
+	Type string `json:"type"`
+	Date string `json:"date"`
+	User User   `json:"user"`
+}
+
+type User struct {
+	ID        int    `json:"id"`
+	Username  string `json:"username"`
+	Name      string `json:"name"`
+	Realm     string `json:"realm"`
+	LastLogin string `json:"lastLogin"`
+}
+
+type Users struct {
+	Count int    `json:"count"`
+	Users []User `json:"user"`
+}
+
+type Pool struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Href string `json:"href"`
+}
+
+type Info struct {
+	Status bool `json:"status"`
+}
+
+type Properties map[string]string
+
+type Agent struct {
+	ID                   int        `json:"id"`
+	Href                 string     `json:"href"`
+	Name                 string     `json:"name"`
+	Pool                 Pool       `json:"pool"`
+	EnabledInfo          Info       `json:"enabledInfo"`
+	AuthorizedInfo       Info       `json:"authorizedInfo"`
+	Connected            bool       `json:"connected"`
+	DisconnectionComment string     `json:"disconnectionComment"`
+	Version              string     `json:"version"`
+	PluginsVersion       string     `json:"pluginsVersion"`
+	UpToDate             bool       `json:"uptodate"`
+	Upgrading            bool       `json:"upgrading"`
+	LastActivityTime     string     `json:"lastActivityTime"`
+	Properties           Properties `json:"properties"`
+}
+
+type Agents struct {
+	Count    int     `json:"count"`
+	NextHref string  `json:"nextHref"`
+	Agents   []Agent `json:"agent"`
+}
+
+type Project struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	ParentProjectID string `json:"parentProjectId"`
+	Href            string `json:"href"`
+}
+
+type AuditAction struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type RelatedEntity struct {
+	Type      string    `json:"type"`
+	Project   Project   `json:"project"`
+	BuildType BuildType `json:"buildType"`
+}
+
+type RelatedEntities struct {
+	Entities []RelatedEntity `json:"entity"`
+}
+
+type AuditEvent struct {
+	ID              int             `json:"id"`
+	Timestamp       string          `json:"timestamp"`
+	Action          AuditAction     `json:"action"`
+	RelatedEntities RelatedEntities `json:"relatedEntities"`
+}
+
+type AuditEvents struct {
+	Count    int          `json:"count"`
+	Href     string       `json:"href"`
+	NextHref string       `json:"nextHref"`
+	Events   []AuditEvent `json:"auditEvent"`
+}
+
+type VcsRoot struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Href    string  `json:"href"`
+	Project Project `json:"project"`
+}
+
+type VcsCheckStatus struct {
+	Status        string `json:"status"`
+	RequestorType string `json:"requestorType"`
+	Timestamp     string `json:"timestamp"`
+}
+
+type VcsStatus struct {
+	Current  VcsCheckStatus `json:"current"`
+	Previous VcsCheckStatus `json:"previous"`
+}
+
+type VcsRootInstance struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Href           string    `json:"href"`
+	VcsRootID      string    `json:"vcs-root-id"`
+	CommitHookMode bool      `json:"commitHookMode"`
+	LastVersion    string    `json:"lastVersion"`
+	Status         VcsStatus `json:"status"`
+	VcsRoot        VcsRoot   `json:"vcs-root"`
+}
+
+type VcsRootInstances struct {
+	Count     int               `json:"count"`
+	Href      string            `json:"href"`
+	NextHref  string            `json:"nextHref"`
+	Instances []VcsRootInstance `json:"vcs-root-instance"`
+}
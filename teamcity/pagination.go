@@ -0,0 +1,75 @@
+package teamcity
+
+import (
+	"context"
+	"reflect"
+	"strings"
+)
+
+// Page is a page of a TeamCity collection linking to the next one
+type Page interface {
+	NextPage() string
+}
+
+func (b *Builds) NextPage() string           { return b.NextHref }
+func (q *BuildQueue) NextPage() string       { return q.NextHref }
+func (b *BuildTypes) NextPage() string       { return b.NextHref }
+func (c *Changes) NextPage() string          { return c.NextHref }
+func (a *Agents) NextPage() string           { return a.NextHref }
+func (i *VcsRootInstances) NextPage() string { return i.NextHref }
+func (e *AuditEvents) NextPage() string      { return e.NextHref }
+
+// PageIterator requests pages of a TeamCity collection following nextHref
+// until the last page
+type PageIterator struct {
+	c     *Client
+	route string
+	err   error
+}
+
+// Pages iterates over the collection at the path, requesting pages of
+// PageSize items unless the locator limits the count. Fields must select
+// nextHref for pages to be followed.
+func (c *Client) Pages(path string, locator Locator, fields Fields) *PageIterator {
+	if c.PageSize > 0 && !locator.Has("count") {
+		locator = locator.Add("count", c.PageSize)
+	}
+	return &PageIterator{
+		c:     c,
+		route: route(path, locator, fields),
+	}
+}
+
+// Next decodes the next page into page, which is reset first, and reports
+// whether there was one. Err tells whether iteration stopped on an error.
+func (it *PageIterator) Next(ctx context.Context, page Page) bool {
+	if len(it.route) == 0 || it.err != nil {
+		return false
+	}
+	v := reflect.ValueOf(page).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	if err := it.c.Get(ctx, it.route, page); err != nil {
+		it.err = err
+		return false
+	}
+	it.route = it.c.nextRoute(page.NextPage())
+	return true
+}
+
+func (it *PageIterator) Err() error {
+	return it.err
+}
+
+// nextRoute turns nextHref, which is absolute and includes the path of the
+// base URL, into a route
+func (c *Client) nextRoute(href string) string {
+	if len(href) == 0 {
+		return ""
+	}
+	route := strings.TrimPrefix(href, "/")
+	prefix := strings.Trim(c.baseURL.Path, "/")
+	if len(prefix) != 0 && strings.HasPrefix(route, prefix+"/") {
+		route = strings.TrimPrefix(route, prefix)
+	}
+	return strings.TrimPrefix(route, "/")
+}
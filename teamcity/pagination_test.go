@@ -0,0 +1,29 @@
+package teamcity
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNextRoute(t *testing.T) {
+	tests := []struct {
+		baseURL  string
+		href     string
+		expected string
+	}{
+		{"https://teamcity.example.com/", "", ""},
+		{"https://teamcity.example.com/", "/app/rest/builds?locator=count:2,start:2", "app/rest/builds?locator=count:2,start:2"},
+		{"https://example.com/teamcity/", "/teamcity/app/rest/builds?locator=start:2", "app/rest/builds?locator=start:2"},
+		{"https://example.com/teamcity", "/teamcity/app/rest/agents?locator=start:2", "app/rest/agents?locator=start:2"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.baseURL)
+		if err != nil {
+			t.Fatalf("Can't parse %s: %v", test.baseURL, err)
+		}
+		c := NewClient(u, "", "")
+		if actual := c.nextRoute(test.href); actual != test.expected {
+			t.Errorf("Expected route %q of %q under %s, got %q", test.expected, test.href, test.baseURL, actual)
+		}
+	}
+}
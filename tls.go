@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig builds the TLS configuration of the TeamCity client
+func (c *Config) loadTLSConfig() error {
+	minVersion, found := tlsVersions[c.apiTLSMinVersion]
+	if !found {
+		return fmt.Errorf("Unknown API minimum TLS version %q", c.apiTLSMinVersion)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         c.apiServerName,
+		InsecureSkipVerify: c.apiInsecureSkipVerify,
+	}
+	if len(c.apiCAFile) != 0 {
+		ca, err := ioutil.ReadFile(c.apiCAFile)
+		if err != nil {
+			return fmt.Errorf("Can't read API CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("Can't parse API CA file: no certificates found in %s", c.apiCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(c.apiCertFile) != 0 || len(c.apiKeyFile) != 0 {
+		if len(c.apiCertFile) == 0 || len(c.apiKeyFile) == 0 {
+			return errors.New("API client certificate and key must be defined together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.apiCertFile, c.apiKeyFile)
+		if err != nil {
+			return fmt.Errorf("Can't load API client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	c.apiTLSConfig = tlsConfig
+	return nil
+}
+
+// loadProxy picks the proxy of the TeamCity client, falling back to the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+func (c *Config) loadProxy() error {
+	if len(c.apiProxy) == 0 {
+		c.apiProxyFunc = http.ProxyFromEnvironment
+		return nil
+	}
+	u, err := url.Parse(c.apiProxy)
+	if err != nil {
+		return fmt.Errorf("Can't parse API proxy URL: %v", err)
+	}
+	c.apiProxyFunc = http.ProxyURL(u)
+	return nil
+}
+
+// newTransport returns the transport of the TeamCity client
+func newTransport(config *Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.apiTLSConfig
+	transport.Proxy = config.apiProxyFunc
+	return transport
+}
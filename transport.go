@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/sirupsen/logrus"
+)
+
+// apiTransport makes requests to TeamCity within the circuit breaker, request
+// budget and rate limit, retrying failed attempts and instrumenting them.
+// Every attempt is limited by the API timeout.
+type apiTransport struct {
+	config  *Config
+	breaker *circuitBreaker
+	limiter *tokenBucket
+	budget  *requestBudget
+	next    http.RoundTripper
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := teamcity.Endpoint(apiRoute(t.config, req.URL))
+	priority := priorityFromContext(req.Context())
+	logrus.Debugf("url: %s", req.URL.String())
+	for attempt := 0; ; attempt++ {
+		// the breaker is checked first, so requests it rejects don't use
+		// up the budget
+		if err := t.breaker.allow(); err != nil {
+			return nil, err
+		}
+		if !t.budget.take(priority) {
+			t.breaker.abort()
+			apiDeferredRequests.WithLabelValues(endpoint, priority.String()).Inc()
+			return nil, fmt.Errorf("Request budget is exhausted for %s priority requests, deferring %s", priority, endpoint)
+		}
+		if err := t.limiter.wait(req.Context()); err != nil {
+			t.breaker.abort()
+			return nil, err
+		}
+		ctx, cancel := t.attemptContext(req.Context())
+		start := time.Now()
+		resp, err := t.next.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			observeRequestError(endpoint, start)
+		} else {
+			observeRequest(endpoint, resp.StatusCode)
+			resp.Body = &instrumentedBody{ReadCloser: resp.Body, endpoint: endpoint, start: start, cancel: cancel}
+		}
+		t.breaker.done(breakerFailure(resp, err))
+		if !retryable(resp, err) || attempt >= t.config.apiRetries || req.Context().Err() != nil {
+			return resp, err
+		}
+		delay, found := retryAfter(resp)
+		if !found {
+			delay = backoff(attempt, t.config.apiRetryBackoff, t.config.apiRetryMaxBackoff)
+		} else if delay > t.config.apiRetryMaxBackoff {
+			// waiting that long would outlast the scrape anyway
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+		}
+		logrus.Debugf("Retrying %s in %s: %s", req.URL.String(), delay, err)
+		apiRetries.WithLabelValues(endpoint).Inc()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attemptContext returns the context of an attempt, which is canceled once
+// the API timeout has passed
+func (t *apiTransport) attemptContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.config.apiTimeout > 0 {
+		return context.WithTimeout(ctx, t.config.apiTimeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensWhenServerIsUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	config := NewConfig()
+	config.apiLogin = fakeLogin
+	config.apiPassword = fakePassword
+	config.apiEndpoint = "http://" + addr + "/"
+	config.apiRetries = 0
+	config.apiRateLimit = 0
+	config.apiBreakerThreshold = 3
+	config.apiBreakerCooldown = time.Minute
+	if err := config.Load(); err != nil {
+		t.Fatalf("Can't load config: %v", err)
+	}
+	client := newClient(config, newRequestBudget(0))
+
+	for i := 0; i < config.apiBreakerThreshold; i++ {
+		_, err := client.GetServer(context.Background())
+		if err == nil || errors.Is(err, errBreakerOpen) {
+			t.Fatalf("Expected request %d to fail connecting, got %v", i+1, err)
+		}
+	}
+	if _, err := client.GetServer(context.Background()); !errors.Is(err, errBreakerOpen) {
+		t.Errorf("Expected the circuit breaker to open after refused connections, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	triggerUnknown = "unknown"
+	teamUnassigned = "unassigned"
+)
+
+var (
+	triggerLabels = []string{"trigger", "project", "team"}
+
+	buildQueueTriggerCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_queue_trigger_count"),
+		"How many builds in queue by trigger type",
+		triggerLabels, nil,
+	)
+
+	buildFinishedTriggerCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "build_finished_trigger_count"),
+		"How many builds finished within the configured window by trigger type",
+		triggerLabels, nil,
+	)
+)
+
+type triggerKey struct {
+	trigger string
+	project string
+	team    string
+}
+
+// newTriggerKey classifies a build by its trigger type and the team of the
+// triggering user. Usernames are never used as label values.
+func (e *Exporter) newTriggerKey(t teamcity.Triggered, project string) triggerKey {
+	trigger := t.Type
+	if len(trigger) == 0 {
+		trigger = triggerUnknown
+	}
+	team := ""
+	if len(t.User.Username) != 0 {
+		team = teamUnassigned
+		if userTeam, found := e.config.userTeams[t.User.Username]; found {
+			team = userTeam
+		}
+	}
+	return triggerKey{trigger: trigger, project: project, team: team}
+}
+
+func collectTriggerCounts(ch chan<- prometheus.Metric, desc *prometheus.Desc, counts map[triggerKey]int) {
+	for key, count := range counts {
+		ch <- prometheus.MustNewConstMetric(
+			desc, prometheus.GaugeValue, float64(count), key.trigger, key.project, key.team)
+	}
+}
+
+func init() {
+	registerCollector("finished_builds", true, 5*time.Minute, priorityNormal, newFinishedBuildsCollector)
+}
+
+type finishedBuildsCollector struct {
+	e *Exporter
+}
+
+func newFinishedBuildsCollector(e *Exporter) Collector {
+	return &finishedBuildsCollector{e: e}
+}
+
+func (c *finishedBuildsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	builds, err := e.client.GetFinishedBuilds(ctx, time.Now().Add(-e.config.finishedBuildsWindow), finishedBuildsLimit)
+	if err != nil {
+		return err
+	}
+	counts := make(map[triggerKey]int)
+	skipped := skippedItems{items: "finished builds"}
+	for _, b := range builds.Builds {
+		project, err := e.GetTopProject(ctx, b.BuildType.ProjectID)
+		if err != nil {
+			logrus.Errorf("Cant get project info: %s", err)
+			skipped.skip(err)
+			continue
+		}
+		counts[e.newTriggerKey(b.Triggered, *project)]++
+	}
+	collectTriggerCounts(ch, buildFinishedTriggerCount, counts)
+	return skipped.err()
+}
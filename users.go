@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const realmDefault = "default"
+
+var (
+	usersCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "users", "count"),
+		"How many users are registered on the TeamCity server",
+		nil, nil,
+	)
+
+	usersActiveCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "users", "active_count"),
+		"How many users logged in within the last days",
+		[]string{"days"}, nil,
+	)
+
+	usersRealmCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "users", "realm_count"),
+		"How many users by authentication realm",
+		[]string{"realm"}, nil,
+	)
+)
+
+func init() {
+	registerCollector("users", true, time.Hour, priorityLow, newUsersCollector)
+}
+
+// usersCollector exports aggregates only, usernames never become label values
+type usersCollector struct {
+	e *Exporter
+}
+
+func newUsersCollector(e *Exporter) Collector {
+	return &usersCollector{e: e}
+}
+
+func (c *usersCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	e := c.e
+	users, err := e.client.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	activeCounts := make([]int, len(e.config.usersActiveDays))
+	realmCounts := make(map[string]int)
+	for _, user := range users.Users {
+		realm := user.Realm
+		if len(realm) == 0 {
+			realm = realmDefault
+		}
+		realmCounts[realm]++
+
+		if len(user.LastLogin) == 0 {
+			continue
+		}
+		lastLogin, err := teamcity.ParseTime(user.LastLogin)
+		if err != nil {
+			logrus.Errorf("Can't parse last login of user %d: %s", user.ID, err)
+			continue
+		}
+		for i, days := range e.config.usersActiveDays {
+			if now.Sub(lastLogin) <= time.Duration(days)*24*time.Hour {
+				activeCounts[i]++
+			}
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		usersCount, prometheus.GaugeValue, float64(len(users.Users)))
+	for i, days := range e.config.usersActiveDays {
+		ch <- prometheus.MustNewConstMetric(
+			usersActiveCount, prometheus.GaugeValue, float64(activeCounts[i]), strconv.Itoa(days))
+	}
+	for realm, count := range realmCounts {
+		ch <- prometheus.MustNewConstMetric(
+			usersRealmCount, prometheus.GaugeValue, float64(count), realm)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// statuses of checks for changes reported by TeamCity
+	vcsCheckStatusFinished = "FINISHED"
+	vcsCheckStatusError    = "ERROR"
+
+	vcsRootStatusOk    = "ok"
+	vcsRootStatusError = "error"
+	vcsRootStatusStale = "stale"
+
+	vcsRootModeCommitHook = "commit_hook"
+	vcsRootModePolling    = "polling"
+)
+
+var (
+	vcsRootLabels = []string{"vcs_root", "project"}
+
+	vcsRootLastCheckTimestamp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "vcs_root", "last_check_timestamp_seconds"),
+		"When the VCS root was last checked for changes",
+		vcsRootLabels, nil,
+	)
+
+	vcsRootStatus = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "vcs_root", "status"),
+		"Status of the last checking for changes of the VCS root",
+		append(vcsRootLabels, "status"), nil,
+	)
+
+	vcsRootErrors = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "vcs_root", "errors_total"),
+		"How many failed checks for changes were observed for the VCS root",
+		vcsRootLabels, nil,
+	)
+
+	vcsRootCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "vcs_root", "count"),
+		"How many VCS roots by the way changes are detected",
+		[]string{"project", "mode"}, nil,
+	)
+)
+
+// vcsRootTracker remembers checks for changes between scrapes,
+// so every failed check is counted only once
+type vcsRootTracker struct {
+	mu      sync.Mutex
+	checked map[string]string
+	errors  map[string]float64
+}
+
+func newVcsRootTracker() *vcsRootTracker {
+	return &vcsRootTracker{
+		checked: make(map[string]string),
+		errors:  make(map[string]float64),
+	}
+}
+
+// observe records the current check of the instance and returns the
+// total number of failed checks of its VCS root
+func (t *vcsRootTracker) observe(instance teamcity.VcsRootInstance, failed bool) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	check := instance.Status.Current
+	if failed && t.checked[instance.ID] != check.Timestamp {
+		t.errors[instance.VcsRootID]++
+	}
+	t.checked[instance.ID] = check.Timestamp
+	return t.errors[instance.VcsRootID]
+}
+
+// prune forgets instances and VCS roots missing from the instances, so
+// deleted VCS roots don't stay in memory
+func (t *vcsRootTracker) prune(instances []teamcity.VcsRootInstance) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	instanceIDs := make(map[string]bool)
+	rootIDs := make(map[string]bool)
+	for _, instance := range instances {
+		instanceIDs[instance.ID] = true
+		rootIDs[instance.VcsRootID] = true
+	}
+	for id := range t.checked {
+		if !instanceIDs[id] {
+			delete(t.checked, id)
+		}
+	}
+	for id := range t.errors {
+		if !rootIDs[id] {
+			delete(t.errors, id)
+		}
+	}
+}
+
+// vcsCheckFailed reports whether the current check for changes of the
+// instance failed: TeamCity reports it as an error, or it finished without
+// TeamCity knowing any version of the repository. Servers which don't
+// report the status of checks leave stalled roots to vcsRootStatusOf.
+func vcsCheckFailed(instance teamcity.VcsRootInstance) bool {
+	switch strings.ToUpper(instance.Status.Current.Status) {
+	case vcsCheckStatusError:
+		return true
+	case vcsCheckStatusFinished:
+		return len(instance.LastVersion) == 0
+	}
+	return false
+}
+
+type vcsRootInfo struct {
+	project    string
+	lastCheck  time.Time
+	failed     bool
+	errors     float64
+	commitHook bool
+}
+
+// vcsRootStatusOf returns the status of the VCS root: error if a check of
+// any of its instances failed, stale if it is polled but wasn't checked
+// for changes within staleAfter, ok otherwise. Roots with commit hooks are
+// polled rarely, so they are never stale.
+func vcsRootStatusOf(root *vcsRootInfo, now time.Time, staleAfter time.Duration) string {
+	switch {
+	case root.failed:
+		return vcsRootStatusError
+	case staleAfter > 0 && !root.commitHook && !root.lastCheck.IsZero() && now.Sub(root.lastCheck) > staleAfter:
+		return vcsRootStatusStale
+	}
+	return vcsRootStatusOk
+}
+
+func init() {
+	registerCollector("vcs_roots", true, 0, priorityNormal, newVcsRootsCollector)
+}
+
+type vcsRootsCollector struct {
+	e       *Exporter
+	tracker *vcsRootTracker
+}
+
+func newVcsRootsCollector(e *Exporter) Collector {
+	return &vcsRootsCollector{
+		e:       e,
+		tracker: newVcsRootTracker(),
+	}
+}
+
+func (c *vcsRootsCollector) Update(ctx context.Context, ch chan<- prometheus.Metric) error {
+	instances, err := c.e.client.GetVcsRootInstances(ctx)
+	if err != nil {
+		return err
+	}
+	c.tracker.prune(instances.Instances)
+
+	// VCS roots with parameters have an instance per distinct set of values
+	roots := make(map[string]*vcsRootInfo)
+	skipped := skippedItems{items: "VCS root instances"}
+	for _, instance := range instances.Instances {
+		root, found := roots[instance.VcsRootID]
+		if !found {
+			project, err := c.e.GetTopProject(ctx, instance.VcsRoot.Project.ID)
+			if err != nil {
+				logrus.Errorf("Cant get project info: %s", err)
+				skipped.skip(err)
+				continue
+			}
+			root = &vcsRootInfo{project: *project}
+			roots[instance.VcsRootID] = root
+		}
+		check := instance.Status.Current
+		failed := vcsCheckFailed(instance)
+		root.failed = root.failed || failed
+		root.errors = c.tracker.observe(instance, failed)
+		root.commitHook = root.commitHook || instance.CommitHookMode
+		if len(check.Timestamp) != 0 {
+			checked, err := teamcity.ParseTime(check.Timestamp)
+			if err != nil {
+				logrus.Errorf("Can't parse check time of VCS root instance %s: %s", instance.ID, err)
+			} else if checked.After(root.lastCheck) {
+				root.lastCheck = checked
+			}
+		}
+	}
+
+	now := time.Now()
+	modeCounts := make(map[[2]string]int)
+	for id, root := range roots {
+		status := vcsRootStatusOf(root, now, c.e.config.vcsRootStaleAfter)
+		mode := vcsRootModePolling
+		if root.commitHook {
+			mode = vcsRootModeCommitHook
+		}
+		modeCounts[[2]string{root.project, mode}]++
+
+		if !root.lastCheck.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				vcsRootLastCheckTimestamp, prometheus.GaugeValue, float64(root.lastCheck.Unix()), id, root.project)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			vcsRootStatus, prometheus.GaugeValue, 1, id, root.project, status)
+		ch <- prometheus.MustNewConstMetric(
+			vcsRootErrors, prometheus.CounterValue, root.errors, id, root.project)
+	}
+	for key, count := range modeCounts {
+		ch <- prometheus.MustNewConstMetric(
+			vcsRootCount, prometheus.GaugeValue, float64(count), key[0], key[1])
+	}
+	return skipped.err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leominov/teamcity-exporter/teamcity"
+)
+
+func TestVcsCheckFailed(t *testing.T) {
+	tests := []struct {
+		status      string
+		lastVersion string
+		expected    bool
+	}{
+		{"ERROR", "abc123", true},
+		{"FINISHED", "", true},
+		{"FINISHED", "abc123", false},
+		{"finished", "abc123", false},
+		{"STARTED", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		instance := teamcity.VcsRootInstance{
+			LastVersion: test.lastVersion,
+			Status:      teamcity.VcsStatus{Current: teamcity.VcsCheckStatus{Status: test.status}},
+		}
+		if actual := vcsCheckFailed(instance); actual != test.expected {
+			t.Errorf("Expected check %q with last version %q to be failed: %v, got %v",
+				test.status, test.lastVersion, test.expected, actual)
+		}
+	}
+}
+
+func TestVcsRootStatusOf(t *testing.T) {
+	now := time.Date(2017, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		root     vcsRootInfo
+		expected string
+	}{
+		{"checked recently", vcsRootInfo{lastCheck: now.Add(-time.Minute)}, vcsRootStatusOk},
+		{"failed", vcsRootInfo{lastCheck: now.Add(-time.Minute), failed: true}, vcsRootStatusError},
+		{"failed long ago", vcsRootInfo{lastCheck: now.Add(-2 * time.Hour), failed: true}, vcsRootStatusError},
+		{"stopped polling", vcsRootInfo{lastCheck: now.Add(-2 * time.Hour)}, vcsRootStatusStale},
+		{"commit hook", vcsRootInfo{lastCheck: now.Add(-2 * time.Hour), commitHook: true}, vcsRootStatusOk},
+		{"never checked", vcsRootInfo{}, vcsRootStatusOk},
+	}
+	for _, test := range tests {
+		if actual := vcsRootStatusOf(&test.root, now, time.Hour); actual != test.expected {
+			t.Errorf("Expected status of root %s to be %q, got %q", test.name, test.expected, actual)
+		}
+	}
+	stalled := vcsRootInfo{lastCheck: now.Add(-2 * time.Hour)}
+	if actual := vcsRootStatusOf(&stalled, now, 0); actual != vcsRootStatusOk {
+		t.Errorf("Expected disabled staleness to report %q, got %q", vcsRootStatusOk, actual)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the web configuration file of the exporter listener, in the
+// format of the Prometheus exporter-toolkit
+type webConfig struct {
+	TLSConfig  webTLSConfig      `yaml:"tls_server_config"`
+	HTTPConfig webHTTPConfig     `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"`
+}
+
+type webTLSConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type webHTTPConfig struct {
+	HTTP2   *bool             `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+var (
+	webTLSVersions = map[string]uint16{
+		"TLS10": tls.VersionTLS10,
+		"TLS11": tls.VersionTLS11,
+		"TLS12": tls.VersionTLS12,
+		"TLS13": tls.VersionTLS13,
+	}
+
+	webClientAuthTypes = map[string]tls.ClientAuthType{
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+
+	webCurves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+)
+
+func loadWebConfig(filename string) (*webConfig, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	wc := &webConfig{}
+	if err := yaml.UnmarshalStrict(content, wc); err != nil {
+		return nil, err
+	}
+	for user, hash := range wc.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash of user %q: %v", user, err)
+		}
+	}
+	return wc, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the listener, nil when
+// TLS is not configured
+func (wc *webConfig) serverTLSConfig() (*tls.Config, error) {
+	c := wc.TLSConfig
+	if len(c.CertFile) == 0 && len(c.KeyFile) == 0 {
+		if len(c.ClientAuth) != 0 || len(c.ClientCAFile) != 0 {
+			return nil, errors.New("client authentication requires cert_file and key_file")
+		}
+		return nil, nil
+	}
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		return nil, errors.New("cert_file and key_file must be defined together")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+	}
+
+	if len(c.MinVersion) != 0 {
+		version, found := webTLSVersions[c.MinVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(c.MaxVersion) != 0 {
+		version, found := webTLSVersions[c.MaxVersion]
+		if !found {
+			return nil, fmt.Errorf("unknown max_version %q", c.MaxVersion)
+		}
+		tlsConfig.MaxVersion = version
+	}
+
+	clientAuth := "NoClientCert"
+	if len(c.ClientAuth) != 0 {
+		clientAuth = c.ClientAuth
+	}
+	authType, found := webClientAuthTypes[clientAuth]
+	if !found {
+		return nil, fmt.Errorf("unknown client_auth_type %q", clientAuth)
+	}
+	tlsConfig.ClientAuth = authType
+	if len(c.ClientCAFile) != 0 {
+		if authType == tls.NoClientCert {
+			return nil, errors.New("client_ca_file requires client_auth_type")
+		}
+		ca, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read client_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+	} else if authType == tls.VerifyClientCertIfGiven || authType == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", clientAuth)
+	}
+
+	if len(c.CipherSuites) != 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, found := suites[name]
+			if !found {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	for _, name := range c.CurvePreferences {
+		curve, found := webCurves[name]
+		if !found {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+	return tlsConfig, nil
+}
+
+// handler wraps h with the basic authentication and headers of the config
+func (wc *webConfig) handler(h http.Handler) http.Handler {
+	if len(wc.Users) != 0 {
+		h = &basicAuthHandler{users: wc.Users, handler: h}
+	}
+	if len(wc.HTTPConfig.Headers) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range wc.HTTPConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// basicAuthHandler requires users to authenticate with their bcrypt hashed
+// passwords before passing requests to the handler
+type basicAuthHandler struct {
+	users   map[string]string
+	handler http.Handler
+}
+
+func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	hash, found := h.users[user]
+	if !found {
+		// unknown users take as long to reject as wrong passwords
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		hash = string(dummyHash)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if !ok || !found || err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+exporterName+`"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// listenAndServe serves the handler on the listen address, with TLS and
+// basic authentication if the web configuration file enables them
+func listenAndServe(config *Config, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    config.listenAddress,
+		Handler: handler,
+	}
+	wc := config.webConfig
+	if wc == nil {
+		return server.ListenAndServe()
+	}
+	server.Handler = wc.handler(handler)
+	if config.webTLSConfig == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = config.webTLSConfig
+	if wc.HTTPConfig.HTTP2 != nil && !*wc.HTTPConfig.HTTP2 {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeFile writes the content to the file in dir returning its path
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("Can't write %s: %v", name, err)
+	}
+	return path
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir
+// returning their paths
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Can't generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Can't create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Can't marshal key: %v", err)
+	}
+	certFile := writeFile(t, dir, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile := writeFile(t, dir, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func TestBasicAuthHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Can't hash password: %v", err)
+	}
+	wc := &webConfig{Users: map[string]string{"prometheus": string(hash)}}
+	handler := wc.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	}))
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		expected int
+	}{
+		{name: "valid credentials", user: "prometheus", password: "secret", expected: http.StatusOK},
+		{name: "wrong password", user: "prometheus", password: "wrong", expected: http.StatusUnauthorized},
+		{name: "unknown user", user: "grafana", password: "secret", expected: http.StatusUnauthorized},
+		{name: "empty password", user: "prometheus", expected: http.StatusUnauthorized},
+		{name: "missing credentials", noAuth: true, expected: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if !test.noAuth {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("Expected status %d with %s, got %d", test.expected, test.name, w.Code)
+		}
+		authenticate := w.Header().Get("WWW-Authenticate")
+		if test.expected == http.StatusUnauthorized && !strings.HasPrefix(authenticate, "Basic ") {
+			t.Errorf("Expected a basic WWW-Authenticate challenge with %s, got %q", test.name, authenticate)
+		}
+		if test.expected == http.StatusOK && w.Body.String() != "metrics" {
+			t.Errorf("Expected the handler to be served with %s, got %q", test.name, w.Body.String())
+		}
+	}
+}
+
+func TestWebConfigHandlerSetsHeaders(t *testing.T) {
+	wc := &webConfig{HTTPConfig: webHTTPConfig{Headers: map[string]string{"X-Frame-Options": "deny"}}}
+	w := httptest.NewRecorder()
+	wc.handler(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if header := w.Header().Get("X-Frame-Options"); header != "deny" {
+		t.Errorf("Expected X-Frame-Options header deny, got %q", header)
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Can't hash password: %v", err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{"valid", "basic_auth_users:\n  prometheus: " + string(hash) + "\n", true},
+		{"empty", "", true},
+		{"plain text password", "basic_auth_users:\n  prometheus: secret\n", false},
+		{"unknown key", "basic_auth_users: {}\nbasic_auth_user: {}\n", false},
+		{"unknown TLS key", "tls_server_config:\n  cert: cert.pem\n", false},
+	}
+	dir := t.TempDir()
+	for _, test := range tests {
+		filename := writeFile(t, dir, "web.yml", []byte(test.content))
+		_, err := loadWebConfig(filename)
+		if test.valid && err != nil {
+			t.Errorf("Expected %s web config to load, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected %s web config to be rejected", test.name)
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+	tests := []struct {
+		name   string
+		config webTLSConfig
+		valid  bool
+	}{
+		{"certificate", webTLSConfig{CertFile: certFile, KeyFile: keyFile}, true},
+		{"certificate without key", webTLSConfig{CertFile: certFile}, false},
+		{"client CA without certificate", webTLSConfig{ClientCAFile: certFile}, false},
+		{"client verification with CA", webTLSConfig{CertFile: certFile, KeyFile: keyFile,
+			ClientAuth: "RequireAndVerifyClientCert", ClientCAFile: certFile}, true},
+		{"client verification without CA", webTLSConfig{CertFile: certFile, KeyFile: keyFile,
+			ClientAuth: "RequireAndVerifyClientCert"}, false},
+		{"client CA without client auth", webTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}, false},
+		{"client CA without certificates", webTLSConfig{CertFile: certFile, KeyFile: keyFile,
+			ClientAuth: "RequireAndVerifyClientCert", ClientCAFile: keyFile}, false},
+		{"unknown client auth", webTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientAuth: "Always"}, false},
+		{"unknown min version", webTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "TLS9"}, false},
+		{"unknown cipher suite", webTLSConfig{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"NULL"}}, false},
+		{"unknown curve", webTLSConfig{CertFile: certFile, KeyFile: keyFile, CurvePreferences: []string{"P999"}}, false},
+	}
+	for _, test := range tests {
+		wc := &webConfig{TLSConfig: test.config}
+		_, err := wc.serverTLSConfig()
+		if test.valid && err != nil {
+			t.Errorf("Expected %s TLS config to be valid, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected %s TLS config to be rejected", test.name)
+		}
+	}
+
+	wc := &webConfig{TLSConfig: webTLSConfig{CertFile: certFile, KeyFile: keyFile,
+		ClientAuth: "RequireAndVerifyClientCert", ClientCAFile: certFile, MinVersion: "TLS13"}}
+	tlsConfig, err := wc.serverTLSConfig()
+	if err != nil {
+		t.Fatalf("Can't build TLS config: %v", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Errorf("Expected client certificates to be verified against the client CA")
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected minimum TLS version 1.3, got %x", tlsConfig.MinVersion)
+	}
+
+	if tlsConfig, err := (&webConfig{}).serverTLSConfig(); tlsConfig != nil || err != nil {
+		t.Errorf("Expected no TLS without certificate, got %v, %v", tlsConfig, err)
+	}
+}